@@ -1,6 +1,7 @@
 package qBT
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/iancoleman/orderedmap"
 	log "github.com/sirupsen/logrus"
@@ -8,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -21,20 +23,56 @@ func check(e error) {
 	}
 }
 
-func checkAndLog(e error, payload []byte) {
+// checkAndLog saves a response which can't be parsed to a file for debugging
+func checkAndLog(e error, payload []byte) error {
 	if e != nil {
 		tmpfile, _ := ioutil.TempFile("", "reflection")
 		tmpfile.Write(payload)
 		log.WithField("filename", tmpfile.Name()).Error("Saved payload in file")
 		tmpfile.Close()
 
-		panic(e)
+		return &RequestError{Err: e}
+	}
+	return nil
+}
+
+// RequestError is returned when qBittorrent can't be reached, rejects a request or sends an invalid response
+type RequestError struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	if e.Err != nil {
+		return "qBittorrent request failed: " + e.Err.Error()
 	}
+	return "qBittorrent request failed: " + strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode)
 }
 
+// Auth is shared by concurrent requests of a session. mutex guards all fields,
+// loginMutex makes sure that only one request logs in again.
 type Auth struct {
+	mutex    sync.RWMutex
 	LoggedIn bool
 	Cookie   http.Cookie
+	// Credentials of the last successful login, used to log in again when the session expires
+	Username string
+	Password string
+	// Failed re-logins are retried with an increasing delay
+	nextLoginAttempt time.Time
+	loginBackoff     time.Duration
+	loginMutex       sync.Mutex
+	// qBittorrent tracks sync/maindata responses per session
+	rid int
+	// The same goes for sync/torrentPeers, but each torrent is synced separately
+	peers map[Hash]*torrentPeers
+}
+
+type torrentPeers struct {
+	rid      int
+	peers    map[string]*PeerInfo
+	lastUsed time.Time
 }
 
 type Hash string
@@ -47,11 +85,35 @@ const (
 
 var RECENTLY_ACTIVE_TIMEOUT = 60 * time.Second
 
+// Like qBittorrent's default Web UI session timeout
+var SESSION_IDLE_TIMEOUT = 1 * time.Hour
+
+// Peers of a torrent which hasn't been requested for this long are synced from scratch
+var PEERS_IDLE_TIMEOUT = 5 * time.Minute
+
+const (
+	MIN_LOGIN_BACKOFF = 5 * time.Second
+	MAX_LOGIN_BACKOFF = 5 * time.Minute
+)
+
+// Connection is a qBittorrent session. Sessions created by Session() share the torrents list.
 type Connection struct {
 	addr         *url.URL
 	client       *http.Client
-	auth         Auth
-	TorrentsList TorrentsList
+	auth         *Auth
+	sessionKey   string
+	sessions     *sessionList
+	TorrentsList *TorrentsList
+}
+
+type sessionList struct {
+	items map[string]*sessionItem
+	mutex sync.Mutex
+}
+
+type sessionItem struct {
+	auth     *Auth
+	lastUsed time.Time
 }
 
 type TorrentsList struct {
@@ -59,7 +121,6 @@ type TorrentsList struct {
 	items     map[Hash]*TorrentInfo
 	activity  map[Hash]*time.Time
 	deleted   map[ID]*time.Time
-	rid       int
 	hashIds   map[ID]Hash
 	lastIndex ID
 	mutex     sync.RWMutex
@@ -165,13 +226,16 @@ func (list *TorrentsList) ItemsNum() int {
 }
 
 func (q *Connection) Init(baseUrl string, client *http.Client, useSync bool) {
+	if q.TorrentsList == nil {
+		q.TorrentsList = &TorrentsList{}
+	}
 	q.TorrentsList.items = make(map[Hash]*TorrentInfo, 0)
 	q.TorrentsList.activity = make(map[Hash]*time.Time)
 	q.TorrentsList.deleted = make(map[ID]*time.Time)
 	q.TorrentsList.hashIds = make(map[ID]Hash)
 	q.TorrentsList.useSync = useSync
-	q.TorrentsList.rid = 0
-	q.auth.LoggedIn = false
+	q.auth = &Auth{}
+	q.sessions = &sessionList{items: make(map[string]*sessionItem)}
 
 	apiAddr, _ := url.Parse("api/v2/")
 	parsedBaseAddr, _ := url.Parse(baseUrl)
@@ -179,10 +243,61 @@ func (q *Connection) Init(baseUrl string, client *http.Client, useSync bool) {
 	q.client = client
 }
 
+// Session returns a connection with its own qBittorrent login, which is identified by key.
+// A new session is kept only after a successful login and is forgotten after SESSION_IDLE_TIMEOUT without use.
+func (q *Connection) Session(key string) *Connection {
+	q.sessions.mutex.Lock()
+	defer q.sessions.mutex.Unlock()
+	now := time.Now()
+	for otherKey, item := range q.sessions.items {
+		if now.Sub(item.lastUsed) > SESSION_IDLE_TIMEOUT {
+			log.Debug("Removing an idle qBittorrent session")
+			delete(q.sessions.items, otherKey)
+		}
+	}
+
+	session := *q
+	session.sessionKey = key
+	if item, exists := q.sessions.items[key]; exists {
+		item.lastUsed = now
+		session.auth = item.auth
+	} else {
+		session.auth = &Auth{}
+	}
+	return &session
+}
+
+func (q *Connection) keepSession() {
+	if q.sessionKey == "" {
+		return
+	}
+	q.sessions.mutex.Lock()
+	defer q.sessions.mutex.Unlock()
+	q.sessions.items[q.sessionKey] = &sessionItem{auth: q.auth, lastUsed: time.Now()}
+}
+
+// DropSessions forgets all sessions, so the next request of every client logs in again
+func (q *Connection) DropSessions() {
+	if q.sessions == nil {
+		return
+	}
+	q.sessions.mutex.Lock()
+	defer q.sessions.mutex.Unlock()
+	q.sessions.items = make(map[string]*sessionItem)
+}
+
 func (q *Connection) IsLoggedIn() bool {
+	q.auth.mutex.RLock()
+	defer q.auth.mutex.RUnlock()
 	return q.auth.LoggedIn
 }
 
+func (q *Connection) cookie() http.Cookie {
+	q.auth.mutex.RLock()
+	defer q.auth.mutex.RUnlock()
+	return q.auth.Cookie
+}
+
 func (q *Connection) MakeRequestURLWithParam(path string, params map[string]string) string {
 	if strings.HasPrefix(path, "/") {
 		panic("Invalid API path: " + path)
@@ -205,51 +320,81 @@ func (q *Connection) MakeRequestURL(path string) string {
 	return q.MakeRequestURLWithParam(path, map[string]string{})
 }
 
-func (q *Connection) UpdateTorrentListDirectly() TorrentInfoList {
+func (q *Connection) UpdateTorrentListDirectly() (TorrentInfoList, error) {
 	torrents := make(TorrentInfoList, 0)
 
 	params := map[string]string{}
 	url := q.MakeRequestURLWithParam("torrents/info", params)
-	torrentsJSON := q.DoGET(url)
-
-	err := json.Unmarshal(torrentsJSON, &torrents)
-	checkAndLog(err, torrentsJSON)
+	if err := q.getJSON(url, &torrents); err != nil {
+		return nil, err
+	}
 
 	q.TorrentsList.items = make(map[Hash]*TorrentInfo)
 	for _, torrent := range torrents {
 		q.TorrentsList.items[torrent.Hash] = torrent
 		torrent.Id = INVALID_ID
 	}
-	return torrents
-}
-
-func (q *Connection) UpdateCachedTorrentsList() (added, deleted TorrentInfoList) {
-	torrentsList := &q.TorrentsList
-	url := q.MakeRequestURLWithParam("sync/maindata", map[string]string{"rid": strconv.Itoa(torrentsList.rid)})
-	mainData := q.DoGET(url)
+	return torrents, nil
+}
+
+func (q *Connection) UpdateCachedTorrentsList() (added, deleted TorrentInfoList, err error) {
+	torrentsList := q.TorrentsList
+	q.auth.mutex.RLock()
+	rid := q.auth.rid
+	q.auth.mutex.RUnlock()
+	url := q.MakeRequestURLWithParam("sync/maindata", map[string]string{"rid": strconv.Itoa(rid)})
+	mainData, err := q.DoGET(url)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	mainDataCache := MainData{}
 
-	err := json.Unmarshal(mainData, &mainDataCache)
-	checkAndLog(err, mainData)
+	err = json.Unmarshal(mainData, &mainDataCache)
+	if err = checkAndLog(err, mainData); err != nil {
+		return nil, nil, err
+	}
 
-	torrentsList.rid = mainDataCache.Rid
 	now := time.Now()
-	for _, deletedHash := range mainDataCache.Torrents_removed {
-		deleted = append(deleted, torrentsList.items[deletedHash])
-		delete(torrentsList.items, deletedHash)
+	removed := mainDataCache.Torrents_removed
+	if mainDataCache.Full_update {
+		// A full update is sent to a new session (e.g. after a restart of qBittorrent) and lists all torrents,
+		// so torrents which are missing in it were removed in the meantime
+		present := make(map[Hash]*json.RawMessage)
+		if mainDataCache.Torrents != nil {
+			err = json.Unmarshal(*mainDataCache.Torrents, &present)
+			if err = checkAndLog(err, *mainDataCache.Torrents); err != nil {
+				return nil, nil, err
+			}
+		}
+		for hash := range torrentsList.items {
+			if _, exists := present[hash]; !exists {
+				removed = append(removed, hash)
+			}
+		}
+	}
+	for _, deletedHash := range removed {
+		// Another session could have already noticed the removal
+		if torrent, exists := torrentsList.items[deletedHash]; exists {
+			deleted = append(deleted, torrent)
+			delete(torrentsList.items, deletedHash)
+		}
 	}
 
 	if mainDataCache.Torrents != nil {
 		orderedTorrentsMap := orderedmap.New()
 
 		err = json.Unmarshal(*mainDataCache.Torrents, &orderedTorrentsMap)
-		checkAndLog(err, *mainDataCache.Torrents)
+		if err = checkAndLog(err, *mainDataCache.Torrents); err != nil {
+			return nil, nil, err
+		}
 
 		nativeTorrentsMap := make(map[Hash]*json.RawMessage)
 
 		err = json.Unmarshal(*mainDataCache.Torrents, &nativeTorrentsMap)
-		checkAndLog(err, *mainDataCache.Torrents)
+		if err = checkAndLog(err, *mainDataCache.Torrents); err != nil {
+			return nil, nil, err
+		}
 
 		for _, hashString := range orderedTorrentsMap.Keys() {
 			hash := Hash(hashString)
@@ -259,163 +404,476 @@ func (q *Connection) UpdateCachedTorrentsList() (added, deleted TorrentInfoList)
 				torrentsList.items[hash] = torrent
 				added = append(added, torrent)
 			}
-			err := json.Unmarshal(*nativeTorrentsMap[hash], torrent)
-			checkAndLog(err, mainData)
-			torrent.Hash = hash
-			torrentsList.activity[hash] = &now
+			// An incremental update contains only changed fields. A full update, which every new session gets,
+			// lists all fields of every torrent, so a torrent is active only if it differs from the list.
+			updated := TorrentInfo{Id: torrent.Id}
+			if !mainDataCache.Full_update {
+				updated = *torrent
+			}
+			err := json.Unmarshal(*nativeTorrentsMap[hash], &updated)
+			if err = checkAndLog(err, mainData); err != nil {
+				return nil, nil, err
+			}
+			updated.Hash = hash
+			if !exists || !mainDataCache.Full_update || !reflect.DeepEqual(updated, *torrent) {
+				torrentsList.activity[hash] = &now
+			}
+			*torrent = updated
 		}
 	}
+	q.auth.mutex.Lock()
+	q.auth.rid = mainDataCache.Rid
+	q.auth.mutex.Unlock()
 
 	return
 }
 
-func (q *Connection) UpdateTorrentsList() {
+func (q *Connection) UpdateTorrentsList() error {
 	q.TorrentsList.mutex.Lock()
 	defer q.TorrentsList.mutex.Unlock()
 
 	if q.TorrentsList.useSync {
-		added, deleted := q.UpdateCachedTorrentsList()
+		added, deleted, err := q.UpdateCachedTorrentsList()
+		if err != nil {
+			return err
+		}
 		q.TorrentsList.DeleteIDsSync(deleted)
 		q.TorrentsList.UpdateIDs(added)
 	} else {
-		added := q.UpdateTorrentListDirectly()
+		added, err := q.UpdateTorrentListDirectly()
+		if err != nil {
+			return err
+		}
 		q.TorrentsList.DeleteIDsFullRescan()
 		q.TorrentsList.UpdateIDs(added)
 	}
+	return nil
 }
 
-func (q *Connection) AddNewCategory(category string) {
+func (q *Connection) AddNewCategory(category string) error {
 	url := q.MakeRequestURLWithParam("torrents/createCategory", map[string]string{"category": category})
-	q.DoGET(url)
+	_, err := q.DoGET(url)
+	return err
 }
 
-func (q *Connection) GetPropsGeneral(hash Hash) (propGeneral PropertiesGeneral) {
-	propGeneralURL := q.MakeRequestURLWithParam("torrents/properties", map[string]string{"hash": string(hash)})
-	propGeneralRaw := q.DoGET(propGeneralURL)
+// getJSON requests url and parses the response into v
+func (q *Connection) getJSON(url string, v interface{}) error {
+	payload, err := q.DoGET(url)
+	if err != nil {
+		return err
+	}
+	return checkAndLog(json.Unmarshal(payload, v), payload)
+}
 
-	err := json.Unmarshal(propGeneralRaw, &propGeneral)
-	checkAndLog(err, propGeneralRaw)
+func (q *Connection) GetPropsGeneral(hash Hash) (propGeneral PropertiesGeneral, err error) {
+	propGeneralURL := q.MakeRequestURLWithParam("torrents/properties", map[string]string{"hash": string(hash)})
+	err = q.getJSON(propGeneralURL, &propGeneral)
 	return
 }
 
-func (q *Connection) GetPropsTrackers(hash Hash) (trackers []PropertiesTrackers) {
+func (q *Connection) GetPropsTrackers(hash Hash) (trackers []PropertiesTrackers, err error) {
 	trackersURL := q.MakeRequestURLWithParam("torrents/trackers", map[string]string{"hash": string(hash)})
-	trackersRaw := q.DoGET(trackersURL)
+	err = q.getJSON(trackersURL, &trackers)
+	return
+}
+
+// GetTorrentPeers returns peers of a torrent. If incremental is set, only changes since the previous
+// incremental call for the same torrent are requested, so the state is kept until the torrent is
+// removed or isn't requested for PEERS_IDLE_TIMEOUT.
+func (q *Connection) GetTorrentPeers(hash Hash, incremental bool) (map[string]PeerInfo, error) {
+	state := &torrentPeers{peers: make(map[string]*PeerInfo)}
+	if incremental {
+		// If the request fails, the next one starts over with a full update
+		if previous := q.takePeersState(hash); previous != nil {
+			state = previous
+		}
+	}
 
-	err := json.Unmarshal(trackersRaw, &trackers)
+	peersURL := q.MakeRequestURLWithParam("sync/torrentPeers", map[string]string{"hash": string(hash), "rid": strconv.Itoa(state.rid)})
+	var resp TorrentPeersData
+	if err := q.getJSON(peersURL, &resp); err != nil {
+		return nil, err
+	}
 
-	checkAndLog(err, trackersRaw)
-	return
+	if resp.Full_update {
+		state.peers = make(map[string]*PeerInfo)
+	}
+	for _, key := range resp.Peers_removed {
+		delete(state.peers, key)
+	}
+	for key, changes := range resp.Peers {
+		peer, exists := state.peers[key]
+		if !exists {
+			peer = &PeerInfo{}
+			state.peers[key] = peer
+		}
+		// Fields which are missing in a partial update keep their previous values
+		err := json.Unmarshal(*changes, peer)
+		if err = checkAndLog(err, *changes); err != nil {
+			return nil, err
+		}
+	}
+	state.rid = resp.Rid
+
+	peers := make(map[string]PeerInfo, len(state.peers))
+	for key, peer := range state.peers {
+		peers[key] = *peer
+	}
+	if incremental {
+		q.keepPeersState(hash, state)
+	}
+	return peers, nil
 }
 
-func (q *Connection) GetPiecesStates(hash Hash) (pieces []byte) {
-	piecesURL := q.MakeRequestURLWithParam("torrents/pieceStates", map[string]string{"hash": string(hash)})
-	piecesRaw := q.DoGET(piecesURL)
+// takePeersState removes the sync state of a torrent from the session and returns it,
+// along the way states of removed and idle torrents are dropped
+func (q *Connection) takePeersState(hash Hash) *torrentPeers {
+	// The torrents list is locked before auth while it's updated, so it isn't looked up under the auth lock
+	q.auth.mutex.RLock()
+	synced := make([]Hash, 0, len(q.auth.peers))
+	for otherHash := range q.auth.peers {
+		synced = append(synced, otherHash)
+	}
+	q.auth.mutex.RUnlock()
+	var removed []Hash
+	for _, otherHash := range synced {
+		if q.TorrentsList.ByHash(otherHash) == nil {
+			removed = append(removed, otherHash)
+		}
+	}
+
+	q.auth.mutex.Lock()
+	defer q.auth.mutex.Unlock()
+	for _, otherHash := range removed {
+		delete(q.auth.peers, otherHash)
+	}
+	now := time.Now()
+	for otherHash, state := range q.auth.peers {
+		if now.Sub(state.lastUsed) > PEERS_IDLE_TIMEOUT {
+			delete(q.auth.peers, otherHash)
+		}
+	}
+	state := q.auth.peers[hash]
+	delete(q.auth.peers, hash)
+	return state
+}
 
-	err := json.Unmarshal(piecesRaw, &pieces)
+func (q *Connection) keepPeersState(hash Hash, state *torrentPeers) {
+	q.auth.mutex.Lock()
+	defer q.auth.mutex.Unlock()
+	if q.auth.peers == nil {
+		q.auth.peers = make(map[Hash]*torrentPeers)
+	}
+	state.lastUsed = time.Now()
+	q.auth.peers[hash] = state
+}
 
-	checkAndLog(err, piecesRaw)
+func (q *Connection) GetPiecesStates(hash Hash) (pieces []byte, err error) {
+	piecesURL := q.MakeRequestURLWithParam("torrents/pieceStates", map[string]string{"hash": string(hash)})
+	err = q.getJSON(piecesURL, &pieces)
 	return
 }
 
-func (q *Connection) GetPreferences() (pref Preferences) {
+func (q *Connection) GetPreferences() (pref Preferences, err error) {
 	prefURL := q.MakeRequestURL("app/preferences")
-	prefRaw := q.DoGET(prefURL)
-
-	err := json.Unmarshal(prefRaw, &pref)
-	checkAndLog(err, prefRaw)
+	err = q.getJSON(prefURL, &pref)
 	return
 }
 
-func (q *Connection) GetTransferInfo() (info TransferInfo) {
-	infoURL := q.MakeRequestURL("transfer/info")
-	infoRaw := q.DoGET(infoURL)
+func (q *Connection) SetPreferences(prefs JsonMap) error {
+	prefsJSON, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	_, err = q.PostForm(q.MakeRequestURL("app/setPreferences"), url.Values{"json": {string(prefsJSON)}})
+	return err
+}
 
-	err := json.Unmarshal(infoRaw, &info)
-	checkAndLog(err, infoRaw)
+func (q *Connection) GetTransferInfo() (info TransferInfo, err error) {
+	infoURL := q.MakeRequestURL("transfer/info")
+	err = q.getJSON(infoURL, &info)
 	return
 }
 
-func (q *Connection) GetVersion() string {
+func (q *Connection) GetSpeedLimitsMode() (bool, error) {
+	modeURL := q.MakeRequestURL("transfer/speedLimitsMode")
+	mode, err := q.DoGET(modeURL)
+	return strings.TrimSpace(string(mode)) == "1", err
+}
+
+func (q *Connection) ToggleSpeedLimitsMode() error {
+	_, err := q.PostForm(q.MakeRequestURL("transfer/toggleSpeedLimitsMode"), url.Values{})
+	return err
+}
+
+func (q *Connection) GetVersion() (string, error) {
 	versionURL := q.MakeRequestURL("app/version")
-	return string(q.DoGET(versionURL))
+	version, err := q.DoGET(versionURL)
+	return string(version), err
 }
 
-func (q *Connection) GetPropsFiles(hash Hash) (files []PropertiesFiles) {
-	filesURL := q.MakeRequestURLWithParam("torrents/files", map[string]string{"hash": string(hash)})
-	filesRaw := q.DoGET(filesURL)
+// VersionAtLeast tells if qBittorrent is of the given version or newer. Versions look like "v4.5.2".
+func (q *Connection) VersionAtLeast(major, minor int) (bool, error) {
+	version, err := q.GetVersion()
+	if err != nil {
+		return false, err
+	}
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(version), "v"), ".", 3)
+	actualMajor, _ := strconv.Atoi(parts[0])
+	actualMinor := 0
+	if len(parts) > 1 {
+		actualMinor, _ = strconv.Atoi(parts[1])
+	}
+	return actualMajor > major || (actualMajor == major && actualMinor >= minor), nil
+}
 
-	err := json.Unmarshal(filesRaw, &files)
-	checkAndLog(err, filesRaw)
+func (q *Connection) GetPropsFiles(hash Hash) (files []PropertiesFiles, err error) {
+	filesURL := q.MakeRequestURLWithParam("torrents/files", map[string]string{"hash": string(hash)})
+	err = q.getJSON(filesURL, &files)
 	return
 }
 
-func (q *Connection) DoGET(url string) []byte {
-	req, err := http.NewRequest("GET", url, nil)
-	check(err)
-	req.AddCookie(&q.auth.Cookie)
+func (q *Connection) DoGET(url string) ([]byte, error) {
+	return q.doRequest(func() (*http.Request, error) {
+		return http.NewRequest("GET", url, nil)
+	})
+}
 
-	resp, err := q.client.Do(req)
-	check(err)
-	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
-	return data
+func (q *Connection) DoPOST(url string, contentType string, body io.Reader) ([]byte, error) {
+	// The body is kept to be able to repeat the request after logging in again
+	payload, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return q.doRequest(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+		if err == nil {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return req, err
+	})
 }
 
-func (q *Connection) DoPOST(url string, contentType string, body io.Reader) []byte {
-	req, err := http.NewRequest("POST", url, body)
-	check(err)
-	req.Header.Set("Content-Type", contentType)
-	req.AddCookie(&q.auth.Cookie)
+// doRequest returns a *RequestError if the request fails or qBittorrent responds with an error status
+func (q *Connection) doRequest(newRequest func() (*http.Request, error)) ([]byte, error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	cookie := q.cookie()
+	req.AddCookie(&cookie)
+	data, status, err := q.send(req)
+	if err == nil && status == http.StatusForbidden && q.relogin(cookie) {
+		if req, err = newRequest(); err != nil {
+			return nil, err
+		}
+		cookie = q.cookie()
+		req.AddCookie(&cookie)
+		data, status, err = q.send(req)
+	}
+	if err != nil {
+		return nil, &RequestError{URL: req.URL.String(), Err: err}
+	}
+	if status >= 400 {
+		// Some errors are expected, e.g. 409 for a rename to an existing name, so it's up to the caller to report them
+		log.WithField("url", req.URL.String()).WithField("status", status).WithField("body", string(data)).
+			Debug("qBittorrent rejected a request")
+		return data, &RequestError{URL: req.URL.String(), StatusCode: status}
+	}
+	return data, nil
+}
 
+func (q *Connection) send(req *http.Request) ([]byte, int, error) {
 	resp, err := q.client.Do(req)
-	check(err)
+	if err != nil {
+		return nil, 0, err
+	}
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
-	return data
+	return data, resp.StatusCode, err
+}
+
+// relogin is called when qBittorrent rejects the expired cookie, e.g. after a restart.
+// It returns true if the request should be repeated with a new cookie.
+func (q *Connection) relogin(expired http.Cookie) bool {
+	q.auth.loginMutex.Lock()
+	defer q.auth.loginMutex.Unlock()
+
+	q.auth.mutex.RLock()
+	loggedIn, cookie, nextLoginAttempt := q.auth.LoggedIn, q.auth.Cookie, q.auth.nextLoginAttempt
+	username, password := q.auth.Username, q.auth.Password
+	q.auth.mutex.RUnlock()
+	if !loggedIn {
+		return false
+	}
+	if cookie.Value != expired.Value {
+		// Another request has already logged in again
+		return true
+	}
+	if time.Now().Before(nextLoginAttempt) {
+		log.Debug("Not logging in to qBittorrent again until ", nextLoginAttempt)
+		return false
+	}
+
+	log.Info("qBittorrent session has expired, logging in again")
+	loggedIn, err := q.Login(username, password)
+
+	q.auth.mutex.Lock()
+	defer q.auth.mutex.Unlock()
+	if loggedIn {
+		q.auth.loginBackoff = 0
+		return true
+	}
+	if err != nil {
+		log.WithError(err).Debug("Login request failed")
+	}
+
+	q.auth.loginBackoff *= 2
+	if q.auth.loginBackoff < MIN_LOGIN_BACKOFF {
+		q.auth.loginBackoff = MIN_LOGIN_BACKOFF
+	} else if q.auth.loginBackoff > MAX_LOGIN_BACKOFF {
+		q.auth.loginBackoff = MAX_LOGIN_BACKOFF
+	}
+	q.auth.nextLoginAttempt = time.Now().Add(q.auth.loginBackoff)
+	log.WithField("retry_in", q.auth.loginBackoff).Error("Can't log in to qBittorrent again")
+	return false
 }
 
-func (q *Connection) PostForm(url string, data url.Values) []byte {
+func (q *Connection) PostForm(url string, data url.Values) ([]byte, error) {
 	return q.DoPOST(url, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
 }
 
-func (q *Connection) Login(username, password string) bool {
+// Login returns false if qBittorrent rejects the credentials and an error if it can't be reached
+func (q *Connection) Login(username, password string) (bool, error) {
 	resp, err := http.PostForm(q.MakeRequestURL("auth/login"),
 		url.Values{"username": {username}, "password": {password}})
-	check(err)
+	if err != nil {
+		return false, &RequestError{URL: q.MakeRequestURL("auth/login"), Err: err}
+	}
+	defer resp.Body.Close()
 	for _, value := range resp.Cookies() {
 		if value != nil {
 			cookie := *value
 			if cookie.Name == "SID" {
+				q.auth.mutex.Lock()
 				q.auth.LoggedIn = true
 				q.auth.Cookie = cookie
-				break
+				q.auth.Username = username
+				q.auth.Password = password
+				q.auth.mutex.Unlock()
+				q.keepSession()
+				return true, nil
 			}
 		}
 	}
-	return q.auth.LoggedIn
+	// A failed attempt doesn't affect an existing session
+	return false, nil
 }
 
-func (q *Connection) PostWithHashes(path string, torrents TorrentInfoList) {
+func (q *Connection) PostWithHashes(path string, torrents TorrentInfoList) error {
 	hashes := torrents.ConcatenateHashes()
-	q.PostForm(q.MakeRequestURL(path), url.Values{"hashes": {hashes}})
+	_, err := q.PostForm(q.MakeRequestURL(path), url.Values{"hashes": {hashes}})
+	return err
 }
 
-func (q *Connection) SetToggleFlag(path string, hash Hash, newState bool) {
-	item := q.TorrentsList.ByHash(hash)
-	if item.Seq_dl != newState {
-		q.PostForm(q.MakeRequestURL(path),
+func (q *Connection) SetUploadLimit(torrents TorrentInfoList, limit int) error {
+	_, err := q.PostForm(q.MakeRequestURL("torrents/setUploadLimit"),
+		url.Values{"hashes": {torrents.ConcatenateHashes()}, "limit": {strconv.Itoa(limit)}})
+	return err
+}
+
+func (q *Connection) SetDownloadLimit(torrents TorrentInfoList, limit int) error {
+	_, err := q.PostForm(q.MakeRequestURL("torrents/setDownloadLimit"),
+		url.Values{"hashes": {torrents.ConcatenateHashes()}, "limit": {strconv.Itoa(limit)}})
+	return err
+}
+
+// SetShareLimits sets limits of a torrent. inactiveSeedingTimeLimit is ignored by qBittorrent before 4.6.
+func (q *Connection) SetShareLimits(hash Hash, ratioLimit float64, seedingTimeLimit, inactiveSeedingTimeLimit int64) error {
+	_, err := q.PostForm(q.MakeRequestURL("torrents/setShareLimits"), url.Values{
+		"hashes":                   {string(hash)},
+		"ratioLimit":               {strconv.FormatFloat(ratioLimit, 'f', -1, 64)},
+		"seedingTimeLimit":         {strconv.FormatInt(seedingTimeLimit, 10)},
+		"inactiveSeedingTimeLimit": {strconv.FormatInt(inactiveSeedingTimeLimit, 10)},
+	})
+	return err
+}
+
+func (q *Connection) AddTrackers(hash Hash, urls []string) error {
+	_, err := q.PostForm(q.MakeRequestURL("torrents/addTrackers"),
+		url.Values{"hash": {string(hash)}, "urls": {strings.Join(urls, "\n")}})
+	return err
+}
+
+func (q *Connection) RemoveTrackers(hash Hash, urls []string) error {
+	_, err := q.PostForm(q.MakeRequestURL("torrents/removeTrackers"),
+		url.Values{"hash": {string(hash)}, "urls": {strings.Join(urls, "|")}})
+	return err
+}
+
+func (q *Connection) EditTracker(hash Hash, origUrl, newUrl string) error {
+	_, err := q.PostForm(q.MakeRequestURL("torrents/editTracker"),
+		url.Values{"hash": {string(hash)}, "origUrl": {origUrl}, "newUrl": {newUrl}})
+	return err
+}
+
+// RenameFile renames a file. id and newName are used by qBittorrent before 4.4, oldPath and newPath by later versions.
+func (q *Connection) RenameFile(hash Hash, id int, oldPath, newPath, newName string) error {
+	_, err := q.PostForm(q.MakeRequestURL("torrents/renameFile"), url.Values{
+		"hash":    {string(hash)},
+		"id":      {strconv.Itoa(id)},
+		"name":    {newName},
+		"oldPath": {oldPath},
+		"newPath": {newPath},
+	})
+	return err
+}
+
+func (q *Connection) RenameFolder(hash Hash, oldPath, newPath string) error {
+	_, err := q.PostForm(q.MakeRequestURL("torrents/renameFolder"),
+		url.Values{"hash": {string(hash)}, "oldPath": {oldPath}, "newPath": {newPath}})
+	return err
+}
+
+func (q *Connection) RenameTorrent(hash Hash, name string) error {
+	_, err := q.PostForm(q.MakeRequestURL("torrents/rename"),
+		url.Values{"hash": {string(hash)}, "name": {name}})
+	return err
+}
+
+func (q *Connection) SetForceStart(torrents TorrentInfoList, value bool) error {
+	_, err := q.PostForm(q.MakeRequestURL("torrents/setForceStart"),
+		url.Values{"hashes": {torrents.ConcatenateHashes()}, "value": {strconv.FormatBool(value)}})
+	return err
+}
+
+func (q *Connection) SetToggleFlag(path string, hash Hash, currentState, newState bool) error {
+	if currentState != newState {
+		_, err := q.PostForm(q.MakeRequestURL(path),
 			url.Values{"hashes": {string(hash)}})
+		return err
 	}
-	return
+	return nil
 }
 
-func (q *Connection) SetSequentialDownload(hash Hash, newState bool) {
-	q.SetToggleFlag("torrents/toggleSequentialDownload", hash, newState)
+// SetSequentialDownload skips torrents which are no longer in the list, since their current state is unknown
+func (q *Connection) SetSequentialDownload(hash Hash, newState bool) error {
+	item := q.TorrentsList.ByHash(hash)
+	if item == nil {
+		log.WithField("hash", hash).Warn("Torrent is not in the list, not changing sequential download")
+		return nil
+	}
+	return q.SetToggleFlag("torrents/toggleSequentialDownload", hash, item.Seq_dl, newState)
 }
 
-func (q *Connection) SetFirstLastPieceFirst(hash Hash, newState bool) {
-	q.SetToggleFlag("torrents/toggleFirstLastPiecePrio", hash, newState)
+// SetFirstLastPieceFirst skips torrents which are no longer in the list, since their current state is unknown
+func (q *Connection) SetFirstLastPieceFirst(hash Hash, newState bool) error {
+	item := q.TorrentsList.ByHash(hash)
+	if item == nil {
+		log.WithField("hash", hash).Warn("Torrent is not in the list, not changing first and last pieces priority")
+		return nil
+	}
+	return q.SetToggleFlag("torrents/toggleFirstLastPiecePrio", hash, item.F_l_piece_prio, newState)
 }
 
 func (list *TorrentsList) DeleteIDsSync(deleted TorrentInfoList) {
@@ -9,30 +9,36 @@ import (
 type JsonMap map[string]interface{}
 
 type TorrentInfo struct {
-	Id             ID      //   Transmission's ID
-	Hash           Hash    //	Torrent hash
-	Name           string  //	Torrent name
-	Size           int64   //	Total size (bytes) of files selected for download
-	Total_size     int64   //	Torrent total size (bytes)
-	Progress       float64 //	Torrent progress (percentage/100)
-	Dlspeed        int     //	Torrent download speed (bytes/s)
-	Upspeed        int     //	Torrent upload speed (bytes/s)
-	Priority       int     //	Torrent priority. Returns -1 if queuing is disabled or torrent is in seed mode
-	Num_seeds      int     //	Number of seeds connected to
-	Num_complete   int     //	Number of seeds in the swarm
-	Num_leechs     int     //	Number of leechers connected to
-	Num_incomplete int     //	Number of leechers in the swarm
-	Ratio          float64 //	Torrent share ratio. Max ratio value: 9999.
-	Eta            int64   //	Torrent ETA (seconds)
-	State          string  //	Torrent state. See table here below for the possible values
-	Seq_dl         bool    //	True if sequential download is enabled
-	F_l_piece_prio bool    //	True if first last piece are prioritized
-	Label          string  //	Label of the torrent
-	Super_seeding  bool    //	True if super seeding is enabled
-	Force_start    bool    //	True if force start is enabled for this torrent
-	Save_path      string  //	Torrent save path
-	Added_on       int64
-	Completion_on  int64 //   Torrent completion time
+	Id                          ID      //   Transmission's ID
+	Hash                        Hash    //	Torrent hash
+	Name                        string  //	Torrent name
+	Size                        int64   //	Total size (bytes) of files selected for download
+	Total_size                  int64   //	Torrent total size (bytes)
+	Progress                    float64 //	Torrent progress (percentage/100)
+	Dlspeed                     int     //	Torrent download speed (bytes/s)
+	Upspeed                     int     //	Torrent upload speed (bytes/s)
+	Priority                    int     //	Torrent priority. Returns -1 if queuing is disabled or torrent is in seed mode
+	Num_seeds                   int     //	Number of seeds connected to
+	Num_complete                int     //	Number of seeds in the swarm
+	Num_leechs                  int     //	Number of leechers connected to
+	Num_incomplete              int     //	Number of leechers in the swarm
+	Ratio                       float64 //	Torrent share ratio. Max ratio value: 9999.
+	Eta                         int64   //	Torrent ETA (seconds)
+	State                       string  //	Torrent state. See table here below for the possible values
+	Seq_dl                      bool    //	True if sequential download is enabled
+	F_l_piece_prio              bool    //	True if first last piece are prioritized
+	Label                       string  //	Label of the torrent
+	Super_seeding               bool    //	True if super seeding is enabled
+	Force_start                 bool    //	True if force start is enabled for this torrent
+	Save_path                   string  //	Torrent save path
+	Added_on                    int64
+	Completion_on               int64   //   Torrent completion time
+	Ratio_limit                 float64 //	Per-torrent share ratio limit. -2 means the global limit, -1 means no limit
+	Seeding_time_limit          int64   //	Per-torrent seeding time limit (minutes). -2 means the global limit, -1 means no limit
+	Inactive_seeding_time_limit *int64  //	Per-torrent inactive seeding time limit (minutes), qBittorrent 4.6+
+	Max_ratio                   float64 //	Effective share ratio limit, -1 if there is no limit
+	Max_seeding_time            int64   //	Effective seeding time limit (minutes), -1 if there is no limit
+	Max_inactive_seeding_time   *int64  //	Effective inactive seeding time limit (minutes), qBittorrent 4.6+
 }
 
 type PeerInfo struct {
@@ -44,6 +50,7 @@ type PeerInfo struct {
 	Client     string
 	Country    string
 	Flags      string
+	Connection string // "BT", "μTP" or "Web"
 	IP         string
 	Progress   float64 //	Torrent progress (percentage/100)
 }
@@ -121,6 +128,13 @@ type MainData struct {
 	Server_state       *TransferInfo
 }
 
+type TorrentPeersData struct {
+	Rid           int
+	Full_update   bool
+	Peers         map[string]*json.RawMessage // Changed fields of each peer, keyed by "address:port"
+	Peers_removed []string
+}
+
 type Preferences struct {
 	Locale                         string      //	Currently selected language (e.g. en_GB for english)
 	Save_path                      string      //	Default save path for torrents, separated by slashes
@@ -161,8 +175,8 @@ type Preferences struct {
 	Enable_utp                     bool        //	True if uTP protocol should be enabled; this option is only available in qBittorent built against libtorrent version 0.16.X and higher
 	Limit_utp_rate                 bool        //	True if [du]l_limit should be applied to uTP connections; this option is only available in qBittorent built against libtorrent version 0.16.X and higher
 	Limit_tcp_overhead             bool        //	True if [du]l_limit should be applied to estimated TCP overhead (service data: e.g. packet headers)
-	Alt_dl_limit                   int         //	Alternative global download speed limit in KiB/s
-	Alt_up_limit                   int         //	Alternative global upload speed limit in KiB/s
+	Alt_dl_limit                   int         //	Alternative global download speed limit in B/s (the API documentation says KiB/s, but it's wrong)
+	Alt_up_limit                   int         //	Alternative global upload speed limit in B/s (the API documentation says KiB/s, but it's wrong)
 	Scheduler_enabled              bool        //	True if alternative limits should be applied according to schedule
 	Schedule_from_hour             int         //	Scheduler starting hour
 	Schedule_from_min              int         //	Scheduler starting minute
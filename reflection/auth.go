@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/h31/Reflection/qBT"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUTH_SUCCESS_CACHE_TIMEOUT = 5 * time.Minute
+	// Failures are cached too, since qBittorrent bans an IP after several failed logins.
+	// Reflection's IP would be banned for all clients, so failed attempts are limited per client IP as well.
+	AUTH_FAILURE_CACHE_TIMEOUT = 30 * time.Second
+	AUTH_MAX_FAILURES_PER_IP   = 3
+	// Limits memory used by failures caused by guessing passwords
+	AUTH_MAX_CACHED_FAILURES = 1000
+
+	PASSWORD_SALT_LENGTH   = 8
+	PASSWORD_SALT_ALPHABET = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./"
+)
+
+// Authenticator checks credentials of an RPC client and returns a qBittorrent session to serve its requests,
+// or nil if the credentials are invalid. Each set of credentials gets its own session.
+// An error means that the credentials couldn't be checked.
+type Authenticator interface {
+	Authenticate(clientIP, username, password string) (*qBT.Connection, error)
+}
+
+// QBTAuthenticator passes client's credentials through to qBittorrent
+type QBTAuthenticator struct {
+	mutex    sync.Mutex
+	results  map[string]authResult
+	failures map[string]authResult // Client IP -> recent failed attempts
+}
+
+type authResult struct {
+	success    bool
+	failures   int
+	validUntil time.Time
+}
+
+func NewQBTAuthenticator() *QBTAuthenticator {
+	return &QBTAuthenticator{results: make(map[string]authResult), failures: make(map[string]authResult)}
+}
+
+func (a *QBTAuthenticator) Authenticate(clientIP, username, password string) (*qBT.Connection, error) {
+	key := credentialsKey(username, password)
+
+	a.mutex.Lock()
+	a.removeExpired(time.Now())
+	result, found := a.results[key]
+	tooManyFailures := a.failures[clientIP].failures >= AUTH_MAX_FAILURES_PER_IP
+	a.mutex.Unlock()
+
+	if found && !result.success {
+		return nil, nil
+	}
+	session := qBTConn.Session(key)
+	if found && session.IsLoggedIn() {
+		return session, nil
+	}
+	if tooManyFailures {
+		log.WithField("client", clientIP).Warn("Too many failed logins, RPC client credentials weren't checked")
+		return nil, nil
+	}
+
+	// Not under the mutex, so that a slow qBittorrent doesn't block other clients
+	success, err := session.Login(username, password)
+	if err != nil {
+		// Not cached, qBittorrent may be back by the next request
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if success {
+		a.results[key] = authResult{success: true, validUntil: time.Now().Add(AUTH_SUCCESS_CACHE_TIMEOUT)}
+		return session, nil
+	}
+	log.WithField("username", username).WithField("client", clientIP).Warn("qBittorrent rejected RPC client credentials")
+	validUntil := time.Now().Add(AUTH_FAILURE_CACHE_TIMEOUT)
+	if len(a.results) < AUTH_MAX_CACHED_FAILURES {
+		a.results[key] = authResult{validUntil: validUntil}
+	}
+	if failures, exists := a.failures[clientIP]; exists || len(a.failures) < AUTH_MAX_CACHED_FAILURES {
+		a.failures[clientIP] = authResult{failures: failures.failures + 1, validUntil: validUntil}
+	}
+	return nil, nil
+}
+
+// removeExpired should be called with the mutex locked
+func (a *QBTAuthenticator) removeExpired(now time.Time) {
+	for key, result := range a.results {
+		if !now.Before(result.validUntil) {
+			delete(a.results, key)
+		}
+	}
+	for clientIP, result := range a.failures {
+		if !now.Before(result.validUntil) {
+			delete(a.failures, clientIP)
+		}
+	}
+}
+
+// clientIP returns the address of an RPC client without a port.
+// All clients of a Unix socket or a reverse proxy share the same address.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Only a digest of credentials is kept in memory
+func credentialsKey(username, password string) string {
+	digest := sha256.Sum256([]byte(username + "\x00" + password))
+	return hex.EncodeToString(digest[:])
+}
+
+// UserList authenticates clients against Reflection's own list of users,
+// while Reflection itself uses its own qBittorrent credentials
+type UserList struct {
+	users       map[string]string // Username -> password hash
+	qBTUsername string
+	qBTPassword string
+}
+
+// LoadUserList reads a file with "username:password hash" lines
+func LoadUserList(filename, qBTUsername, qBTPassword string) (*UserList, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &UserList{users: make(map[string]string), qBTUsername: qBTUsername, qBTPassword: qBTPassword}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.LastIndex(line, ":")
+		if separator <= 0 || !isPasswordHash(line[separator+1:]) {
+			return nil, fmt.Errorf("%s:%d: expected \"username:password hash\", use -hash-password to generate a hash", filename, lineNum)
+		}
+		list.users[line[:separator]] = line[separator+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded %d RPC users from %s", len(list.users), filename)
+	return list, nil
+}
+
+func (list *UserList) Authenticate(clientIP, username, password string) (*qBT.Connection, error) {
+	hash, found := list.users[username]
+	if !found || !passwordMatches(hash, password) {
+		log.WithField("username", username).Warn("Invalid RPC client credentials")
+		return nil, nil
+	}
+	session := qBTConn.Session("user:" + username)
+	if session.IsLoggedIn() {
+		return session, nil
+	}
+	loggedIn, err := session.Login(list.qBTUsername, list.qBTPassword)
+	if err != nil {
+		return nil, err
+	}
+	if !loggedIn {
+		return nil, &RPCError{Result: "Can't log in to qBittorrent", HTTPStatus: http.StatusBadGateway}
+	}
+	return session, nil
+}
+
+// Password hashes use the same salted SHA1 format as Transmission's rpc-password,
+// so existing settings.json values can be reused
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, PASSWORD_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	for i := range salt {
+		salt[i] = PASSWORD_SALT_ALPHABET[int(salt[i])%len(PASSWORD_SALT_ALPHABET)]
+	}
+	return saltedHash(password, string(salt)), nil
+}
+
+func saltedHash(password, salt string) string {
+	digest := sha1.Sum([]byte(password + salt))
+	return "{" + hex.EncodeToString(digest[:]) + salt
+}
+
+func isPasswordHash(hash string) bool {
+	return len(hash) > 1+2*sha1.Size && hash[0] == '{'
+}
+
+func passwordMatches(hash, password string) bool {
+	if !isPasswordHash(hash) {
+		return false
+	}
+	salt := hash[1+2*sha1.Size:]
+	return subtle.ConstantTimeCompare([]byte(saltedHash(password, salt)), []byte(hash)) == 1
+}
@@ -36,7 +36,9 @@ func (c *Cache) fill(hash qBT.Hash, data JsonMap) {
 	c.FilledAt[hash] = time.Now()
 }
 
-func (c *Cache) GetOrFill(hash qBT.Hash, dest JsonMap, cacheAllowed bool, fillFunc func(dest JsonMap)) {
+// GetOrFill copies cached values into dest. If they are missing or outdated, they are filled by fillFunc,
+// and nothing is cached if it fails.
+func (c *Cache) GetOrFill(hash qBT.Hash, dest JsonMap, cacheAllowed bool, fillFunc func(dest JsonMap) error) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -46,10 +48,28 @@ func (c *Cache) GetOrFill(hash qBT.Hash, dest JsonMap, cacheAllowed bool, fillFu
 	} else {
 		log.WithField("hash", hash).Debug("Executing callback to fill the cache")
 		newValues := make(JsonMap)
-		fillFunc(newValues)
+		if err := fillFunc(newValues); err != nil {
+			return err
+		}
 		dest.addAll(newValues)
 		c.fill(hash, newValues)
 	}
+	return nil
+}
+
+func (c *Cache) SetTimeout(timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Timeout = timeout
+}
+
+func (c *Cache) Invalidate(hash qBT.Hash) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.Values, hash)
+	delete(c.FilledAt, hash)
 }
 
 func (m JsonMap) addAll(source JsonMap) {
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const ENV_PREFIX = "REFLECTION_"
+
+var configFile = flag.String("config", "", "TOML configuration file, keys are the same as command line flags (env: REFLECTION_CONFIG)")
+
+// Short aliases are set on the command line only
+var flagAliases = map[string]string{
+	"v": "verbose",
+	"d": "debug",
+	"r": "api-addr",
+	"p": "port",
+}
+
+// Settings which are not read from a configuration file or an environment
+var commandLineOnlyFlags = map[string]struct{}{
+	"config":        {},
+	"hash-password": {},
+}
+
+// Settings which are applied on SIGHUP, others require a restart
+var reloadableFlags = map[string]struct{}{
+	"verbose":       {},
+	"debug":         {},
+	"cache-timeout": {},
+	"no-session-id": {},
+	"users-file":    {},
+	"qbt-username":  {},
+	"qbt-password":  {},
+}
+
+func envName(flagName string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// loadConfig parses the command line and fills the settings which weren't specified there.
+// Precedence, from highest to lowest: command line flags, REFLECTION_* environment variables,
+// the configuration file, default values.
+func loadConfig(args []string) error {
+	err := flag.CommandLine.Parse(args)
+	if err != nil {
+		return err
+	}
+	_, err = applyConfig(nil)
+	return err
+}
+
+// applyConfig sets flags from the environment and the configuration file. If only is not nil,
+// other flags are left as they are. It returns names of the flags whose values were changed.
+func applyConfig(only map[string]struct{}) (changed []string, err error) {
+	fromCommandLine := make(map[string]struct{})
+	flag.Visit(func(f *flag.Flag) {
+		if name, isAlias := flagAliases[f.Name]; isAlias {
+			fromCommandLine[name] = struct{}{}
+		}
+		fromCommandLine[f.Name] = struct{}{}
+	})
+
+	filename := *configFile
+	if _, set := fromCommandLine["config"]; !set && os.Getenv(envName("config")) != "" {
+		filename = os.Getenv(envName("config"))
+	}
+	fileValues, err := readConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	flag.VisitAll(func(f *flag.Flag) {
+		_, isAlias := flagAliases[f.Name]
+		_, commandLineOnly := commandLineOnlyFlags[f.Name]
+		_, set := fromCommandLine[f.Name]
+		if isAlias || commandLineOnly || set {
+			return
+		}
+		if _, selected := only[f.Name]; only != nil && !selected {
+			return
+		}
+
+		// Settings removed from the file or the environment get their default values back
+		value, source := f.DefValue, "default value"
+		if fileValue, exists := fileValues[f.Name]; exists {
+			value, source = fileValue, filename
+		}
+		if envValue, exists := os.LookupEnv(envName(f.Name)); exists {
+			value, source = envValue, envName(f.Name)
+		}
+		if value == f.Value.String() {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid value %q for %s: %v", source, value, f.Name, err))
+			return
+		}
+		changed = append(changed, f.Name)
+	})
+	if len(errs) > 0 {
+		return changed, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return changed, nil
+}
+
+// readConfigFile returns values from the file as strings, in the same format as on the command line
+func readConfigFile(filename string) (map[string]string, error) {
+	values := make(map[string]string)
+	if filename == "" {
+		return values, nil
+	}
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(filename, &raw); err != nil {
+		return nil, err
+	}
+
+	var unknown []string
+	for key, value := range raw {
+		_, isAlias := flagAliases[key]
+		_, commandLineOnly := commandLineOnlyFlags[key]
+		if flag.Lookup(key) == nil || isAlias || commandLineOnly {
+			unknown = append(unknown, key)
+			continue
+		}
+		switch value.(type) {
+		case string, bool, int64, float64:
+			values[key] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string, a number or a boolean", filename, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%s: unknown settings: %s", filename, strings.Join(unknown, ", "))
+	}
+	return values, nil
+}
+
+// runtimeSettings is a snapshot of reloadable settings. It is never modified after being stored,
+// so request handlers read it without locking while a reload replaces it.
+type runtimeSettings struct {
+	noSessionID   bool
+	debug         bool
+	cacheTimeout  time.Duration
+	qBTUsername   string
+	qBTPassword   string
+	authenticator Authenticator
+}
+
+var currentSettings atomic.Value
+
+func init() {
+	currentSettings.Store(&runtimeSettings{authenticator: NewQBTAuthenticator()})
+}
+
+func settings() *runtimeSettings {
+	return currentSettings.Load().(*runtimeSettings)
+}
+
+// applyRuntimeSettings builds a new settings snapshot from the reloadable flags and replaces the current one.
+// If the users file can't be loaded, the previous authentication settings stay in effect.
+func applyRuntimeSettings() error {
+	previous := settings()
+	current := &runtimeSettings{
+		noSessionID:   *noSessionID,
+		debug:         *debug,
+		cacheTimeout:  time.Duration(*cacheTimeout) * time.Second,
+		qBTUsername:   *qBTUsername,
+		qBTPassword:   *qBTPassword,
+		authenticator: previous.authenticator,
+	}
+
+	switch {
+	case current.debug:
+		log.SetLevel(log.DebugLevel)
+	case *verbose:
+		log.SetLevel(log.InfoLevel)
+	default:
+		log.SetLevel(log.WarnLevel)
+	}
+
+	propsCache.SetTimeout(current.cacheTimeout)
+	trackersCache.SetTimeout(current.cacheTimeout)
+	peersFromCache.SetTimeout(current.cacheTimeout)
+
+	var err error
+	if *usersFile != "" {
+		var users *UserList
+		users, err = LoadUserList(*usersFile, current.qBTUsername, current.qBTPassword)
+		if err == nil {
+			current.authenticator = users
+		} else {
+			current.qBTUsername, current.qBTPassword = previous.qBTUsername, previous.qBTPassword
+		}
+	} else if _, passthrough := previous.authenticator.(*QBTAuthenticator); !passthrough {
+		current.authenticator = NewQBTAuthenticator()
+	}
+
+	if current.qBTUsername != previous.qBTUsername || current.qBTPassword != previous.qBTPassword {
+		// Sessions logged in with the old credentials must not outlive them
+		qBTConn.DropSessions()
+	}
+	currentSettings.Store(current)
+	return err
+}
+
+func reloadConfigOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadConfig()
+	}
+}
+
+func reloadConfig() {
+	defer func() {
+		// A broken configuration file shouldn't stop the running server
+		if recovered := recover(); recovered != nil {
+			log.Error("Can't reload configuration: ", recovered)
+		}
+	}()
+
+	log.Info("Reloading configuration")
+	changed, err := applyConfig(reloadableFlags)
+	if err != nil {
+		log.Error("Can't reload configuration: ", err)
+	}
+	err = applyRuntimeSettings()
+	if err != nil {
+		// The previous list of users stays in effect
+		log.Error("Can't load users: ", err)
+	}
+	if len(changed) > 0 {
+		log.Info("Changed settings: ", strings.Join(changed, ", "))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/h31/Reflection/qBT"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// RPCError is reported to a client as a regular Transmission response
+// with a descriptive "result" field.
+type RPCError struct {
+	Result     string
+	HTTPStatus int
+}
+
+func (e *RPCError) Error() string {
+	return e.Result
+}
+
+// Like Transmission, invalid arguments are reported with HTTP 200 and a descriptive result
+func InvalidArgument(format string, args ...interface{}) *RPCError {
+	return &RPCError{Result: fmt.Sprintf(format, args...), HTTPStatus: http.StatusOK}
+}
+
+func BadRequest(format string, args ...interface{}) *RPCError {
+	return &RPCError{Result: fmt.Sprintf(format, args...), HTTPStatus: http.StatusBadRequest}
+}
+
+// ArgumentError reports request arguments that can't be parsed
+func ArgumentError(err error) *RPCError {
+	return InvalidArgument("Invalid arguments: %s", describeJSONError(err))
+}
+
+// describeJSONError makes a decoding error readable for a client, e.g. "ids must be a list, got string"
+func describeJSONError(err error) string {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+		return fmt.Sprintf("%s must be %s, got %s", typeErr.Field, jsonTypeName(typeErr.Type), typeErr.Value)
+	}
+	return strings.TrimPrefix(err.Error(), "json: ")
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Ptr:
+		return jsonTypeName(t.Elem())
+	default:
+		return "a number"
+	}
+}
+
+// jsonString formats a value from a request the way a client has sent it
+func jsonString(v interface{}) string {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(encoded)
+}
+
+// toRPCError converts an error returned during request processing into an RPCError
+func toRPCError(err error) *RPCError {
+	switch err := err.(type) {
+	case *RPCError:
+		return err
+	case *qBT.RequestError:
+		return &RPCError{Result: err.Error(), HTTPStatus: http.StatusBadGateway}
+	default:
+		return &RPCError{Result: "Internal error: " + err.Error(), HTTPStatus: http.StatusInternalServerError}
+	}
+}
+
+// isConflict tells if qBittorrent has refused a request with HTTP 409,
+// e.g. because a file or a tracker with the new name already exists
+func isConflict(err error) bool {
+	requestErr, ok := err.(*qBT.RequestError)
+	return ok && requestErr.StatusCode == http.StatusConflict
+}
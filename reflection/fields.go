@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/h31/Reflection/qBT"
+	"github.com/h31/Reflection/transmission"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// Sources of torrent-get fields, from the cheapest to the most expensive
+type fieldSource int
+
+const (
+	SOURCE_TEMPLATE   fieldSource = iota // Predefined value from transmission.TorrentGetBase
+	SOURCE_LIST                          // Torrents list, which is always up to date
+	SOURCE_QUEUE                         // Queue positions, derived from the whole torrents list
+	SOURCE_PROPERTIES                    // torrents/properties, cached
+	SOURCE_TRACKERS                      // torrents/trackers, cached
+	SOURCE_PEERS_FROM                    // sync/torrentPeers, only peer counts are cached
+	SOURCE_FILES                         // torrents/files
+	SOURCE_PEERS                         // sync/torrentPeers
+	SOURCE_PIECES                        // torrents/pieceStates
+)
+
+var fieldSourceNames = map[fieldSource]string{
+	SOURCE_TEMPLATE:   "template",
+	SOURCE_LIST:       "list",
+	SOURCE_QUEUE:      "queue",
+	SOURCE_PROPERTIES: "properties",
+	SOURCE_TRACKERS:   "trackers",
+	SOURCE_PEERS_FROM: "peersFrom",
+	SOURCE_FILES:      "files",
+	SOURCE_PEERS:      "peers",
+	SOURCE_PIECES:     "pieces",
+}
+
+func (source fieldSource) String() string {
+	return fieldSourceNames[source]
+}
+
+type torrentField struct {
+	Source fieldSource
+	// RPC version which introduced the field, zero if it's available in every version
+	Since int
+	// Converts data of the list source. Fields of other sources are taken by name from the result of
+	// the source's Map* function (or the template).
+	Convert func(src *qBT.TorrentInfo) interface{}
+}
+
+func listField(convert func(src *qBT.TorrentInfo) interface{}) torrentField {
+	return torrentField{Source: SOURCE_LIST, Convert: convert}
+}
+
+var torrentFields = map[string]torrentField{
+	"id":           listField(func(src *qBT.TorrentInfo) interface{} { return src.Id }),
+	"hashString":   listField(func(src *qBT.TorrentInfo) interface{} { return src.Hash }),
+	"name":         listField(func(src *qBT.TorrentInfo) interface{} { return EscapeString(src.Name) }),
+	"addedDate":    listField(func(src *qBT.TorrentInfo) interface{} { return src.Added_on }),
+	"startDate":    listField(func(src *qBT.TorrentInfo) interface{} { return src.Added_on }), // TODO
+	"doneDate":     listField(func(src *qBT.TorrentInfo) interface{} { return src.Completion_on }),
+	"sizeWhenDone": listField(func(src *qBT.TorrentInfo) interface{} { return src.Size }),
+	"totalSize":    listField(func(src *qBT.TorrentInfo) interface{} { return src.Total_size }),
+	"downloadDir":  listField(func(src *qBT.TorrentInfo) interface{} { return EscapeString(src.Save_path) }),
+	"rateDownload": listField(func(src *qBT.TorrentInfo) interface{} { return src.Dlspeed }),
+	"rateUpload":   listField(func(src *qBT.TorrentInfo) interface{} { return src.Upspeed }),
+	"uploadRatio":  listField(func(src *qBT.TorrentInfo) interface{} { return src.Ratio }),
+	"eta": listField(func(src *qBT.TorrentInfo) interface{} {
+		if src.Eta >= 0 {
+			return src.Eta
+		}
+		return -1
+	}),
+	"status": listField(func(src *qBT.TorrentInfo) interface{} { return qBTStateToTransmissionStatus(src.State) }),
+	"recheckProgress": listField(func(src *qBT.TorrentInfo) interface{} {
+		if qBTStateToTransmissionStatus(src.State) == TR_STATUS_CHECK {
+			return src.Progress
+		}
+		return 0
+	}),
+	"error":              listField(func(src *qBT.TorrentInfo) interface{} { return qBTStateToTransmissionError(src.State) }),
+	"isStalled":          listField(func(src *qBT.TorrentInfo) interface{} { return qBTStateToTransmissionStalled(src.State) }),
+	"percentDone":        listField(func(src *qBT.TorrentInfo) interface{} { return src.Progress }),
+	"peersGettingFromUs": listField(func(src *qBT.TorrentInfo) interface{} { return src.Num_leechs }),
+	"peersSendingToUs":   listField(func(src *qBT.TorrentInfo) interface{} { return src.Num_seeds }),
+	"leftUntilDone":      listField(func(src *qBT.TorrentInfo) interface{} { return float64(src.Size) * (1 - src.Progress) }),
+	"desiredAvailable":   listField(func(src *qBT.TorrentInfo) interface{} { return float64(src.Size) * (1 - src.Progress) }), // TODO
+	"haveUnchecked":      listField(func(src *qBT.TorrentInfo) interface{} { return 0 }),                                      // TODO
+	"metadataPercentComplete": listField(func(src *qBT.TorrentInfo) interface{} {
+		if src.State == "metaDL" {
+			return 0
+		}
+		return 1
+	}),
+	"manualAnnounceTime": listField(func(src *qBT.TorrentInfo) interface{} { return manualAnnounces.Get(src.Hash) }),
+	"seedRatioMode":      listField(func(src *qBT.TorrentInfo) interface{} { return qBTShareLimitToTRMode(src.Ratio_limit) }),
+	"seedRatioLimit":     listField(func(src *qBT.TorrentInfo) interface{} { return math.Max(src.Max_ratio, 0) }),
+	"seedIdleMode": listField(func(src *qBT.TorrentInfo) interface{} {
+		current, _ := idleSeedingLimit(src)
+		return qBTShareLimitToTRMode(float64(current))
+	}),
+	"seedIdleLimit": listField(func(src *qBT.TorrentInfo) interface{} {
+		_, effective := idleSeedingLimit(src)
+		if effective > 0 {
+			return effective
+		}
+		return 0
+	}),
+	"percentComplete":     {Source: SOURCE_LIST, Since: 17, Convert: func(src *qBT.TorrentInfo) interface{} { return src.Progress }},
+	"sequential_download": {Source: SOURCE_LIST, Since: 18, Convert: func(src *qBT.TorrentInfo) interface{} { return src.Seq_dl }},
+
+	"errorString":         {Source: SOURCE_TEMPLATE},
+	"isFinished":          {Source: SOURCE_TEMPLATE},
+	"activityDate":        {Source: SOURCE_TEMPLATE},
+	"secondsDownloading":  {Source: SOURCE_TEMPLATE},
+	"secondsSeeding":      {Source: SOURCE_TEMPLATE},
+	"isPrivate":           {Source: SOURCE_TEMPLATE},
+	"honorsSessionLimits": {Source: SOURCE_TEMPLATE},
+	"webseedsSendingToUs": {Source: SOURCE_TEMPLATE},
+	"bandwidthPriority":   {Source: SOURCE_TEMPLATE},
+	"etaIdle":             {Source: SOURCE_TEMPLATE},
+	"torrentFile":         {Source: SOURCE_TEMPLATE},
+	"webseeds":            {Source: SOURCE_TEMPLATE},
+	"magnetLink":          {Source: SOURCE_TEMPLATE},
+	"group":               {Source: SOURCE_TEMPLATE, Since: 17},
+
+	"queuePosition": {Source: SOURCE_QUEUE},
+
+	"pieceSize":         {Source: SOURCE_PROPERTIES},
+	"pieceCount":        {Source: SOURCE_PROPERTIES},
+	"comment":           {Source: SOURCE_PROPERTIES},
+	"dateCreated":       {Source: SOURCE_PROPERTIES},
+	"creator":           {Source: SOURCE_PROPERTIES},
+	"haveValid":         {Source: SOURCE_PROPERTIES},
+	"downloadedEver":    {Source: SOURCE_PROPERTIES},
+	"uploadedEver":      {Source: SOURCE_PROPERTIES},
+	"peersConnected":    {Source: SOURCE_PROPERTIES},
+	"peersFrom":         {Source: SOURCE_PEERS_FROM},
+	"corruptEver":       {Source: SOURCE_PROPERTIES},
+	"uploadLimited":     {Source: SOURCE_PROPERTIES},
+	"uploadLimit":       {Source: SOURCE_PROPERTIES},
+	"downloadLimited":   {Source: SOURCE_PROPERTIES},
+	"downloadLimit":     {Source: SOURCE_PROPERTIES},
+	"maxConnectedPeers": {Source: SOURCE_PROPERTIES},
+	"peer-limit":        {Source: SOURCE_PROPERTIES},
+
+	"trackers":     {Source: SOURCE_TRACKERS},
+	"trackerStats": {Source: SOURCE_TRACKERS},
+	"trackerList":  {Source: SOURCE_TRACKERS, Since: 17},
+
+	"files":             {Source: SOURCE_FILES},
+	"fileStats":         {Source: SOURCE_FILES},
+	"priorities":        {Source: SOURCE_FILES},
+	"wanted":            {Source: SOURCE_FILES},
+	"file-count":        {Source: SOURCE_FILES, Since: 17},
+	"primary-mime-type": {Source: SOURCE_FILES, Since: 17},
+
+	"peers": {Source: SOURCE_PEERS},
+
+	"pieces": {Source: SOURCE_PIECES},
+}
+
+func (field torrentField) IsAvailable() bool {
+	return field.Since <= int(*rpcVersion)
+}
+
+// torrentSources fetches qBittorrent data of a single torrent when it's needed for the first time.
+// Queue positions are shared by all torrents of a torrent-get request.
+type torrentSources struct {
+	conn         *qBT.Connection
+	torrent      *qBT.TorrentInfo
+	cacheAllowed bool
+	queue        *queuePositions
+	mapped       map[fieldSource]JsonMap
+	peers        map[string]qBT.PeerInfo
+}
+
+func newTorrentSources(conn *qBT.Connection, torrent *qBT.TorrentInfo, cacheAllowed bool, queue *queuePositions) *torrentSources {
+	return &torrentSources{
+		conn:         conn,
+		torrent:      torrent,
+		cacheAllowed: cacheAllowed,
+		queue:        queue,
+		mapped:       make(map[fieldSource]JsonMap),
+	}
+}
+
+func (s *torrentSources) Value(name string) (interface{}, error) {
+	field, known := torrentFields[name]
+	if !known {
+		return nil, nil
+	}
+	if field.Convert != nil {
+		return field.Convert(s.torrent), nil
+	}
+	mapped, err := s.get(field.Source)
+	return mapped[name], err
+}
+
+func (s *torrentSources) get(source fieldSource) (JsonMap, error) {
+	if mapped, fetched := s.mapped[source]; fetched {
+		return mapped, nil
+	}
+
+	hash := s.torrent.Hash
+	mapped := make(JsonMap)
+	var err error
+	logger := log.WithField("id", s.torrent.Id).WithField("hash", hash)
+	switch source {
+	case SOURCE_TEMPLATE:
+		mapped = JsonMap(transmission.TorrentGetBase)
+	case SOURCE_QUEUE:
+		mapped["queuePosition"] = s.queue.Position(s.torrent)
+	case SOURCE_PROPERTIES:
+		logger.Debug("Props required")
+		err = propsCache.GetOrFill(hash, mapped, s.cacheAllowed, func(dest JsonMap) error {
+			propGeneral, err := s.conn.GetPropsGeneral(hash)
+			if err != nil {
+				return err
+			}
+			MapPropsGeneral(dest, propGeneral)
+			addPropertiesToCommentField(dest, s.torrent, propGeneral)
+			return nil
+		})
+	case SOURCE_TRACKERS:
+		logger.Debug("Trackers required")
+		err = trackersCache.GetOrFill(hash, mapped, s.cacheAllowed, func(dest JsonMap) error {
+			trackers, err := s.conn.GetPropsTrackers(hash)
+			if err != nil {
+				return err
+			}
+			MapPropsTrackers(dest, trackers)
+			MapPropsTrackerStats(dest, trackers, s.torrent)
+			return nil
+		})
+	case SOURCE_PEERS_FROM:
+		logger.Debug("Peer counts required")
+		err = peersFromCache.GetOrFill(hash, mapped, s.cacheAllowed, func(dest JsonMap) error {
+			peers, err := s.getPeers()
+			if err != nil {
+				return err
+			}
+			MapPeersFrom(dest, peers)
+			return nil
+		})
+	case SOURCE_FILES:
+		logger.Debug("Files required")
+		var files []qBT.PropertiesFiles
+		if files, err = s.conn.GetPropsFiles(hash); err == nil {
+			MapPropsFiles(mapped, files)
+		}
+	case SOURCE_PEERS:
+		logger.Debug("Peers required")
+		var peers map[string]qBT.PeerInfo
+		if peers, err = s.getPeers(); err == nil {
+			MapPropsPeers(mapped, peers)
+		}
+	case SOURCE_PIECES:
+		logger.Debug("Pieces required")
+		var pieces []byte
+		if pieces, err = s.conn.GetPiecesStates(hash); err == nil {
+			MapPieceStates(mapped, pieces)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.mapped[source] = mapped
+	return mapped, nil
+}
+
+// getPeers requests peers once for both peer details and peer counts. Peers are synced incrementally
+// only for a single requested torrent, a scan of the whole list would keep sync state of every torrent.
+func (s *torrentSources) getPeers() (map[string]qBT.PeerInfo, error) {
+	if s.peers == nil {
+		peers, err := s.conn.GetTorrentPeers(s.torrent.Hash, !s.cacheAllowed)
+		if err != nil {
+			return nil, err
+		}
+		s.peers = peers
+	}
+	return s.peers, nil
+}
+
+// fieldsHandler lists supported torrent-get fields. It requires the same credentials as RPC.
+func fieldsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := authenticate(w, r)
+	if err != nil {
+		rpcErr := toRPCError(err)
+		http.Error(w, rpcErr.Result, rpcErr.HTTPStatus)
+		return
+	}
+	if conn == nil {
+		return
+	}
+
+	type fieldInfo struct {
+		Name      string `json:"name"`
+		Source    string `json:"source"`
+		Since     int    `json:"since,omitempty"`
+		Available bool   `json:"available"`
+	}
+	fields := make([]fieldInfo, 0, len(torrentFields))
+	for name, field := range torrentFields {
+		fields = append(fields, fieldInfo{
+			Name:      name,
+			Source:    field.Source.String(),
+			Since:     field.Since,
+			Available: field.IsAvailable(),
+		})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Name < fields[j].Name
+	})
+
+	respBody, err := json.MarshalIndent(JsonMap{
+		"rpc-version": *rpcVersion,
+		"fields":      fields,
+	}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(respBody)
+}
+
+// queuePositions are computed from the torrents list on the first request and reused for other torrents
+type queuePositions struct {
+	list      *qBT.TorrentsList
+	notQueued map[qBT.Hash]int
+}
+
+func newQueuePositions(conn *qBT.Connection) *queuePositions {
+	return &queuePositions{list: conn.TorrentsList}
+}
+
+// Position converts qBittorrent's queue position, which starts from 1. Torrents which aren't queued
+// (seeding or queueing is disabled) get distinct positions after all queued torrents, in the order of their ids.
+func (q *queuePositions) Position(torrent *qBT.TorrentInfo) int {
+	if torrent.Priority > 0 {
+		return torrent.Priority - 1
+	}
+	if q.notQueued == nil {
+		q.notQueued = make(map[qBT.Hash]int)
+		queued := 0
+		var notQueued qBT.TorrentInfoList
+		for _, other := range q.list.Slice() {
+			if other.Priority > 0 {
+				queued++
+			} else {
+				notQueued = append(notQueued, other)
+			}
+		}
+		// Slice is sorted by id
+		for i, other := range notQueued {
+			q.notQueued[other.Hash] = queued + i
+		}
+	}
+	return q.notQueued[torrent.Hash]
+}
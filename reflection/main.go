@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
@@ -13,14 +14,20 @@ import (
 	"github.com/h31/Reflection/transmission"
 	"github.com/ricochet2200/go-disk-usage/du"
 	log "github.com/sirupsen/logrus"
+	"hash/crc32"
 	"io/ioutil"
 	"math"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 )
@@ -30,9 +37,20 @@ var (
 	debug            = flag.Bool("debug", false, "Enable debug output")
 	apiAddr          = flag.String("api-addr", "http://localhost:8080/", "qBittorrent API address")
 	port             = flag.Uint("port", 9091, "Transmission RPC port")
+	listenAddrs      = flag.String("listen", "", "Comma-separated list of addresses to listen on, \"host:port\" or \"unix:/path/to/socket\" (default: all interfaces on -port)")
+	tlsCert          = flag.String("tls-cert", "", "TLS certificate file, enables HTTPS on TCP addresses")
+	tlsKey           = flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA      = flag.String("tls-client-ca", "", "Require client certificates signed by CAs from this file")
+	unixSocketMode   = flag.String("unix-socket-mode", "", "Permissions of Unix sockets in octal, e.g. 0660 (default: set by umask)")
 	cacheTimeout     = flag.Uint("cache-timeout", 15, "Cache timeout (in seconds)")
 	disableKeepAlive = flag.Bool("disable-keep-alive", false, "Disable HTTP Keep-Alive in requests (may be necessary for older qBittorrent versions)")
 	useSync          = flag.Bool("sync", true, "Use Sync endpoint (recommended)")
+	rpcVersion       = flag.Uint("rpc-version", transmission.RPCVersionLegacy, "Transmission RPC version to emulate, 17 or newer enables Transmission 4 fields")
+	noSessionID      = flag.Bool("no-session-id", false, "Don't require X-Transmission-Session-Id header (makes RPC vulnerable to CSRF)")
+	usersFile        = flag.String("users-file", "", "File with RPC users, one \"username:password hash\" per line. If not set, credentials are checked by qBittorrent")
+	qBTUsername      = flag.String("qbt-username", "", "qBittorrent username (used with -users-file)")
+	qBTPassword      = flag.String("qbt-password", "", "qBittorrent password (used with -users-file)")
+	hashPassword     = flag.String("hash-password", "", "Print a password hash for -users-file and exit")
 )
 
 func init() {
@@ -40,7 +58,6 @@ func init() {
 	flag.BoolVar(debug, "d", false, "")
 	flag.StringVar(apiAddr, "r", "http://localhost:8080/", "")
 	flag.UintVar(port, "p", 9091, "")
-	flag.Parse()
 }
 
 var deprecatedFields = map[string]struct{}{
@@ -85,103 +102,139 @@ func IsFieldDeprecated(field string) bool {
 //	return filtered
 //}
 
-func parseIDsField(args *json.RawMessage) qBT.TorrentInfoList {
-	qBTConn.UpdateTorrentsList()
+func parseIDsField(conn *qBT.Connection, args *json.RawMessage) (qBT.TorrentInfoList, error) {
+	if err := conn.UpdateTorrentsList(); err != nil {
+		return nil, err
+	}
 
-	if args == nil {
+	if args == nil || len(*args) == 0 {
 		log.Debug("No IDs provided")
-		return qBTConn.TorrentsList.Slice()
+		return conn.TorrentsList.Slice(), nil
 	}
 
 	var ids interface{}
 	err := json.Unmarshal(*args, &ids)
-	Check(err)
+	if err != nil {
+		return nil, InvalidArgument("Invalid ids: %s", describeJSONError(err))
+	}
 
+	// Like Transmission, silently skip IDs which don't exist
 	switch ids := ids.(type) {
 	case float64:
 		log.Debug("Query a single ID")
-		return []*qBT.TorrentInfo{qBTConn.TorrentsList.ByID(qBT.ID(ids))}
+		if torrent := conn.TorrentsList.ByID(qBT.ID(ids)); torrent != nil {
+			return qBT.TorrentInfoList{torrent}, nil
+		}
+		return qBT.TorrentInfoList{}, nil
 	case []interface{}:
 		log.Debug("Query an ID list of length ", len(ids))
-		result := make([]*qBT.TorrentInfo, len(ids))
-		for i, value := range ids {
+		result := make(qBT.TorrentInfoList, 0, len(ids))
+		for _, value := range ids {
+			var torrent *qBT.TorrentInfo
 			switch id := value.(type) {
 			case float64:
-				result[i] = qBTConn.TorrentsList.ByID(qBT.ID(id))
+				torrent = conn.TorrentsList.ByID(qBT.ID(id))
 			case string:
 				hash := qBT.Hash(id)
-				result[i] = qBTConn.TorrentsList.ByHash(hash)
+				torrent = conn.TorrentsList.ByHash(hash)
+			default:
+				return nil, InvalidArgument("Invalid id %s: expected a number or a hash string", jsonString(value))
 			}
-			if result[i] == nil {
-				panic("hash not found")
+			if torrent != nil {
+				result = append(result, torrent)
+			} else {
+				log.WithField("id", value).Debug("Torrent not found")
 			}
 		}
-		return result
+		return result, nil
 	case string:
 		if ids != "recently-active" {
-			panic("Unsupported ID type: " + ids)
+			return nil, InvalidArgument("Unsupported ids: %s", ids)
 		}
 		log.Debug("Query recently-active")
 		if *useSync {
-			return qBTConn.TorrentsList.GetActive()
+			return conn.TorrentsList.GetActive(), nil
 		} else {
-			return qBTConn.TorrentsList.Slice()
+			return conn.TorrentsList.Slice(), nil
 		}
 	default:
-		log.Panicf("Unknown ID type: %s", ids)
-		panic("Unknown ID type")
+		return nil, InvalidArgument("Invalid ids %s: expected an id, a list of ids or \"recently-active\"", jsonString(ids))
 	}
 }
 
-func parseActionArgument(args json.RawMessage) qBT.TorrentInfoList {
+func parseActionArgument(conn *qBT.Connection, args json.RawMessage) (qBT.TorrentInfoList, error) {
 	var req struct {
-		Ids json.RawMessage
+		Ids *json.RawMessage
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, ArgumentError(err)
 	}
-	err := json.Unmarshal(args, &req)
-	Check(err)
 
-	return parseIDsField(&req.Ids)
-}
-
-func MapTorrentList(dst JsonMap, src *qBT.TorrentInfo) {
-	for key, value := range transmission.TorrentGetBase {
-		dst[key] = value
-	}
-	dst["hashString"] = src.Hash
-	convertedName := EscapeString(src.Name)
-	dst["name"] = convertedName
-	dst["addedDate"] = src.Added_on
-	dst["startDate"] = src.Added_on // TODO
-	dst["doneDate"] = src.Completion_on
-	dst["sizeWhenDone"] = src.Size
-	dst["totalSize"] = src.Total_size
-	dst["downloadDir"] = EscapeString(src.Save_path)
-	dst["rateDownload"] = src.Dlspeed
-	dst["rateUpload"] = src.Upspeed
-	dst["uploadRatio"] = src.Ratio
-	if src.Eta >= 0 {
-		dst["eta"] = src.Eta
-	} else {
-		dst["eta"] = -1
+	return parseIDsField(conn, req.Ids)
+}
+
+const TR_RATIOLIMIT_GLOBAL = 0
+const TR_RATIOLIMIT_SINGLE = 1
+const TR_RATIOLIMIT_UNLIMITED = 2
+
+const QBT_SHARE_LIMIT_GLOBAL = -2
+const QBT_SHARE_LIMIT_UNLIMITED = -1
+
+// Idle limit modes share values with ratio limit modes (TR_IDLELIMIT_*)
+func qBTShareLimitToTRMode(limit float64) int {
+	switch {
+	case limit == QBT_SHARE_LIMIT_GLOBAL:
+		return TR_RATIOLIMIT_GLOBAL
+	case limit < 0:
+		return TR_RATIOLIMIT_UNLIMITED
+	default:
+		return TR_RATIOLIMIT_SINGLE
 	}
-	dst["status"] = qBTStateToTransmissionStatus(src.State)
-	if dst["status"] == TR_STATUS_CHECK {
-		dst["recheckProgress"] = src.Progress
-	} else {
-		dst["recheckProgress"] = 0
-	}
-	dst["error"] = qBTStateToTransmissionError(src.State)
-	dst["isStalled"] = qBTStateToTransmissionStalled(src.State)
-	dst["percentDone"] = src.Progress
-	dst["peersGettingFromUs"] = src.Num_leechs
-	dst["peersSendingToUs"] = src.Num_seeds
-	dst["leftUntilDone"] = float64(src.Size) * (1 - src.Progress)
-	dst["desiredAvailable"] = float64(src.Size) * (1 - src.Progress) // TODO
-	dst["haveUnchecked"] = 0                                         // TODO
-	if src.State == "metaDL" {
-		dst["metadataPercentComplete"] = 0
-	} else {
-		dst["metadataPercentComplete"] = 1
+}
+
+// idleSeedingLimit returns the qBittorrent limit closest to Transmission's idle seeding limit and the effective value of it.
+// qBittorrent 4.6+ limits inactive seeding time like Transmission, older versions limit only total seeding time.
+func idleSeedingLimit(torrent *qBT.TorrentInfo) (current, effective int64) {
+	if torrent.Inactive_seeding_time_limit == nil {
+		return torrent.Seeding_time_limit, torrent.Max_seeding_time
+	}
+	effective = QBT_SHARE_LIMIT_UNLIMITED
+	if torrent.Max_inactive_seeding_time != nil {
+		effective = *torrent.Max_inactive_seeding_time
+	}
+	return *torrent.Inactive_seeding_time_limit, effective
+}
+
+// trShareLimitToQBT returns a new qBittorrent share limit, keeping the current one if nothing has to be changed.
+// effective is the limit the torrent is currently subject to, used when switching to a per-torrent limit
+// without providing a value.
+func trShareLimitToQBT(current, effective float64, mode *int, limit *float64) float64 {
+	if mode == nil {
+		if limit != nil && qBTShareLimitToTRMode(current) == TR_RATIOLIMIT_SINGLE {
+			return *limit
+		}
+		return current // qBittorrent can't store a limit which isn't in use
+	}
+	switch *mode {
+	case TR_RATIOLIMIT_GLOBAL:
+		return QBT_SHARE_LIMIT_GLOBAL
+	case TR_RATIOLIMIT_SINGLE:
+		switch {
+		case limit != nil:
+			return *limit
+		case current >= 0:
+			return current
+		case effective >= 0:
+			return effective
+		default:
+			log.Warn("Per-torrent limit was enabled without a value, ignoring")
+			return current
+		}
+	case TR_RATIOLIMIT_UNLIMITED:
+		return QBT_SHARE_LIMIT_UNLIMITED
+	default:
+		log.Warn("Unknown limit mode: ", *mode)
+		return current
 	}
 }
 
@@ -220,7 +273,7 @@ func qBTStateToTransmissionStatus(state string) int {
 		return TR_STATUS_CHECK // TR_STATUS_CHECK
 	case "queuedDL":
 		return TR_STATUS_DOWNLOAD_WAIT // TR_STATUS_DOWNLOAD_WAIT
-	case "downloading", "stalledDL", "forceDL":
+	case "downloading", "stalledDL", "forcedDL", "metaDL", "forcedMetaDL":
 		return TR_STATUS_DOWNLOAD // TR_STATUS_DOWNLOAD
 	case "queuedUP":
 		return TR_STATUS_SEED_WAIT // TR_STATUS_SEED_WAIT
@@ -308,30 +361,20 @@ func MapPropsGeneral(dst JsonMap, propGeneral qBT.PropertiesGeneral) {
 	dst["downloadedEver"] = propGeneral.Total_downloaded
 	dst["uploadedEver"] = propGeneral.Total_uploaded
 	dst["peersConnected"] = propGeneral.Peers
-	dst["peersFrom"] = struct {
-		fromCache    int
-		fromDht      int
-		fromIncoming int
-		fromLdp      int
-		fromLtep     int
-		fromPex      int
-		fromTracker  int
-	}{
-		fromTracker: propGeneral.Peers,
-	}
 	dst["corruptEver"] = propGeneral.Total_wasted
 
-	if propGeneral.Up_limit >= 0 {
+	// qBittorrent reports -1 (or 0) for "no limit"
+	if propGeneral.Up_limit > 0 {
 		dst["uploadLimited"] = true
-		dst["uploadLimit"] = propGeneral.Up_limit
+		dst["uploadLimit"] = propGeneral.Up_limit / transmission.SpeedBytes
 	} else {
 		dst["uploadLimited"] = false
 		dst["uploadLimit"] = 0
 	}
 
-	if propGeneral.Dl_limit >= 0 {
+	if propGeneral.Dl_limit > 0 {
 		dst["downloadLimited"] = true
-		dst["downloadLimit"] = propGeneral.Dl_limit // TODO: Kb/s?
+		dst["downloadLimit"] = propGeneral.Dl_limit / transmission.SpeedBytes
 	} else {
 		dst["downloadLimited"] = false
 		dst["downloadLimit"] = 0
@@ -341,24 +384,13 @@ func MapPropsGeneral(dst JsonMap, propGeneral qBT.PropertiesGeneral) {
 	dst["peer-limit"] = propGeneral.Nb_connections_limit // TODO: What's it?
 }
 
-func MapPropsPeers(dst JsonMap, hash qBT.Hash) {
-	url := qBTConn.MakeRequestURLWithParam("sync/torrentPeers", map[string]string{"hash": string(hash), "rid": "0"})
-	torrents := qBTConn.DoGET(url)
+func MapPropsPeers(dst JsonMap, peers map[string]qBT.PeerInfo) {
+	trPeers := make([]transmission.PeerInfo, 0, len(peers))
 
-	log.Debug(string(torrents))
-	var resp struct {
-		//Peers map[string]qBT.PeerInfo
-		Peers map[string]qBT.PeerInfo
-	}
-	err := json.Unmarshal(torrents, &resp)
-	Check(err)
-	//var trPeers []transmission.PeerInfo
-	trPeers := make([]transmission.PeerInfo, 0)
-
-	for _, peer := range resp.Peers {
+	for _, peer := range peers {
 		clientName := EscapeString(peer.Client)
 		country := EscapeString(peer.Country)
-		trPeers = append(trPeers, transmission.PeerInfo{
+		trPeer := transmission.PeerInfo{
 			RateToPeer:   peer.Up_speed,
 			RateToClient: peer.Dl_speed,
 			ClientName:   clientName,
@@ -367,17 +399,65 @@ func MapPropsPeers(dst JsonMap, hash qBT.Hash) {
 			Address:      peer.IP,
 			Progress:     peer.Progress,
 			Port:         peer.Port,
-		})
+		}
+		mapPeerFlags(&trPeer, peer)
+		trPeers = append(trPeers, trPeer)
 	}
 
 	dst["peers"] = trPeers
 }
 
+// mapPeerFlags decodes qBittorrent's flag letters:
+// D/d - we are interested and the peer unchokes/chokes us, K - the peer unchokes us but we aren't interested,
+// U/u - the peer is interested and we unchoke/choke it, ? - we unchoke the peer but it isn't interested,
+// I - incoming connection, E/e - encrypted traffic/handshake, P - uTP
+func mapPeerFlags(dst *transmission.PeerInfo, peer qBT.PeerInfo) {
+	hasFlag := func(flag rune) bool {
+		return strings.ContainsRune(peer.Flags, flag)
+	}
+	dst.IsDownloadingFrom = hasFlag('D')
+	dst.IsUploadingTo = hasFlag('U')
+	dst.ClientIsInterested = hasFlag('D') || hasFlag('d')
+	dst.ClientIsChoked = !hasFlag('D') && !hasFlag('K')
+	dst.PeerIsInterested = hasFlag('U') || hasFlag('u')
+	dst.PeerIsChoked = !hasFlag('U') && !hasFlag('?')
+	dst.IsIncoming = hasFlag('I')
+	dst.IsEncrypted = hasFlag('E') || hasFlag('e')
+	dst.IsUTP = hasFlag('P') || peer.Connection == "μTP"
+}
+
+// MapPeersFrom counts peers by qBittorrent's flag letters. A peer is counted once,
+// the same way as Transmission does, and a peer without a source flag came from a tracker.
+// qBittorrent doesn't report peers received in LTEP handshakes or from a resume cache.
+func MapPeersFrom(dst JsonMap, peers map[string]qBT.PeerInfo) {
+	var peersFrom transmission.PeersFrom
+	for _, peer := range peers {
+		flags := peer.Flags
+		switch {
+		case strings.ContainsRune(flags, 'I'):
+			peersFrom.FromIncoming++
+		case strings.ContainsRune(flags, 'H'):
+			peersFrom.FromDht++
+		case strings.ContainsRune(flags, 'X'):
+			peersFrom.FromPex++
+		case strings.ContainsRune(flags, 'L'):
+			peersFrom.FromLpd++
+		default:
+			peersFrom.FromTracker++
+		}
+	}
+	dst["peersFrom"] = peersFrom
+}
+
 func MapPropsTrackers(dst JsonMap, trackers []qBT.PropertiesTrackers) {
 	trackersList := make([]JsonMap, len(trackers))
+	announceURLs := make([]string, 0, len(trackers))
 
 	for i, value := range trackers {
-		id := i
+		if !isPseudoTracker(value.Url) {
+			announceURLs = append(announceURLs, value.Url)
+		}
+		id := trackerID(value.Url)
 		trackersList[i] = make(JsonMap)
 		trackersList[i]["announce"] = value.Url
 		trackersList[i]["id"] = id
@@ -386,13 +466,15 @@ func MapPropsTrackers(dst JsonMap, trackers []qBT.PropertiesTrackers) {
 	}
 
 	dst["trackers"] = trackersList
+	// One announce URL per line, tiers are separated by empty lines. All trackers are in the same tier, see above.
+	dst["trackerList"] = strings.Join(announceURLs, "\n")
 }
 
 func MapPropsTrackerStats(dst JsonMap, trackers []qBT.PropertiesTrackers, torrentInfo *qBT.TorrentInfo) {
 	trackerStats := make([]JsonMap, len(trackers))
 
 	for i, value := range trackers {
-		id := i
+		id := trackerID(value.Url)
 
 		trackerStats[i] = make(JsonMap)
 		for key, value := range transmission.TrackerStatsTemplate {
@@ -415,6 +497,16 @@ func MapPropsTrackerStats(dst JsonMap, trackers []qBT.PropertiesTrackers, torren
 	dst["trackerStats"] = trackerStats
 }
 
+// trackerID derives a tracker ID from its URL, so it doesn't change when other trackers are added or removed
+func trackerID(url string) int {
+	return int(crc32.ChecksumIEEE([]byte(url)) & math.MaxInt32)
+}
+
+// isPseudoTracker reports whether an entry is one of "** [DHT] **", "** [PeX] **" or "** [LSD] **"
+func isPseudoTracker(url string) bool {
+	return strings.HasPrefix(url, "** [")
+}
+
 func decodeTrackerStatus(status int) string {
 	switch status {
 	case 0:
@@ -448,144 +540,187 @@ func MapPropsFiles(dst JsonMap, filesInfo []qBT.PropertiesFiles) {
 		files[i]["name"] = convertedName
 
 		fileStats[i]["bytesCompleted"] = float64(value.Size) * value.Progress
-		if value.Priority == 0 {
+		if value.Priority == QBT_FILE_PRIORITY_SKIP {
 			fileStats[i]["wanted"] = false
 			wanted[i] = 0
 		} else {
 			fileStats[i]["wanted"] = true
 			wanted[i] = 1
 		}
-		fileStats[i]["priority"] = 0 // TODO
-		priorities[i] = 0            // TODO
+		fileStats[i]["priority"] = qBTFilePriorityToTR(value.Priority)
+		priorities[i] = qBTFilePriorityToTR(value.Priority)
 	}
 
 	dst["files"] = files
 	dst["fileStats"] = fileStats
 	dst["priorities"] = priorities
 	dst["wanted"] = wanted
+	dst["file-count"] = fileNum
+	dst["primary-mime-type"] = primaryMIMEType(filesInfo)
+}
+
+// Like Transmission, the primary MIME type is the one with the largest total size of files
+func primaryMIMEType(filesInfo []qBT.PropertiesFiles) string {
+	sizes := make(map[string]int64)
+	primary := "application/octet-stream"
+	for _, file := range filesInfo {
+		mimeType := mime.TypeByExtension(path.Ext(file.Name))
+		if mimeType == "" {
+			continue
+		}
+		mimeType = strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+		sizes[mimeType] += file.Size
+		if primarySize, found := sizes[primary]; !found || sizes[mimeType] > primarySize {
+			primary = mimeType
+		}
+	}
+	return primary
+}
+
+const TR_PRI_LOW = -1
+const TR_PRI_NORMAL = 0
+const TR_PRI_HIGH = 1
+
+const QBT_FILE_PRIORITY_SKIP = 0
+const QBT_FILE_PRIORITY_LOW = 1
+const QBT_FILE_PRIORITY_NORMAL = 6
+const QBT_FILE_PRIORITY_HIGH = 7
+
+func qBTFilePriorityToTR(priority int) int {
+	switch {
+	case priority <= QBT_FILE_PRIORITY_LOW:
+		return TR_PRI_LOW
+	case priority >= QBT_FILE_PRIORITY_HIGH:
+		return TR_PRI_HIGH
+	default:
+		return TR_PRI_NORMAL // Includes libtorrent's default priority (4) reported by older qBittorrent versions
+	}
+}
+
+func trFilePriorityToQBT(priority int) int {
+	switch {
+	case priority < TR_PRI_NORMAL:
+		return QBT_FILE_PRIORITY_LOW
+	case priority > TR_PRI_NORMAL:
+		return QBT_FILE_PRIORITY_HIGH
+	default:
+		return QBT_FILE_PRIORITY_NORMAL
+	}
 }
 
 var propsCache = Cache{Timeout: time.Duration(*cacheTimeout) * time.Second}
 var trackersCache = Cache{Timeout: time.Duration(*cacheTimeout) * time.Second}
+var peersFromCache = Cache{Timeout: time.Duration(*cacheTimeout) * time.Second}
 
-func TorrentGet(args json.RawMessage) (JsonMap, string) {
+func TorrentGet(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
 	var req transmission.GetRequest
-	err := json.Unmarshal(args, &req)
-	Check(err)
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, ArgumentError(err)
+	}
+	if req.Format != "" && req.Format != transmission.FormatObjects && req.Format != transmission.FormatTable {
+		return nil, InvalidArgument("Invalid format: %s", req.Format)
+	}
 
-	torrents := parseIDsField(req.Ids)
+	torrents, err := parseIDsField(conn, req.Ids)
+	if err != nil {
+		return nil, err
+	}
 	severalIDsRequired := len(torrents) > 1
-	fields := req.Fields
-	filesNeeded := false
-	trackersNeeded := false
-	trackerStatsNeeded := false
-	peersNeeded := false
-	propsGeneralNeeded := false
-	piecesNeeded := false
-	for _, field := range fields {
-		additionalRequestsNeeded := true
-		switch field {
-		case "files", "fileStats", "priorities", "wanted":
-			filesNeeded = true
-		case "trackers":
-			trackersNeeded = true
-		case "trackerStats":
-			trackerStatsNeeded = true
-		case "peers":
-			peersNeeded = true
-		case "pieceSize", "pieceCount",
-			"comment", "dateCreated", "creator",
-			"haveValid", "downloadedEver",
-			"uploadedEver", "peersConnected", "peersFrom",
-			"corruptEver", "uploadLimited", "uploadLimit", "downloadLimited",
-			"downloadLimit", "maxConnectedPeers", "peer-limit":
-			propsGeneralNeeded = true
-		case "pieces":
-			piecesNeeded = true
-		default:
-			additionalRequestsNeeded = false
+	fields := make([]string, 0, len(req.Fields))
+	for _, name := range req.Fields {
+		field, known := torrentFields[name]
+		switch {
+		case !known:
+			if !IsFieldDeprecated(name) {
+				log.Warn("Unsupported field: ", name)
+			}
+		case !field.IsAvailable():
+			// A client of an older RPC version doesn't expect newer fields, just like Transmission doesn't know them
+			log.Debugf("Field %s is not available in rpc-version %d", name, *rpcVersion)
+			continue
+		case field.Source >= SOURCE_PROPERTIES && severalIDsRequired:
+			log.Info("Field which caused a full torrent scan (slow op!): " + name)
+		}
+		fields = append(fields, name)
+	}
+
+	var response JsonMap
+	if req.Format == transmission.FormatTable {
+		table, err := torrentTable(conn, torrents, fields, severalIDsRequired)
+		if err != nil {
+			return nil, err
 		}
-		if additionalRequestsNeeded && severalIDsRequired {
-			log.Info("Field which caused a full torrent scan (slow op!): " + field)
+		response = JsonMap{"torrents": table}
+	} else {
+		objects, err := torrentObjects(conn, torrents, fields, severalIDsRequired)
+		if err != nil {
+			return nil, err
 		}
+		response = JsonMap{"torrents": objects}
+	}
+	if err := addRemovedList(req.Ids, response); err != nil {
+		return nil, err
 	}
+	return response, nil
+}
 
+// Unknown fields are null in both formats
+func torrentObjects(conn *qBT.Connection, torrents qBT.TorrentInfoList, fields []string, cacheAllowed bool) ([]JsonMap, error) {
 	resultList := make([]JsonMap, len(torrents))
+	queue := newQueuePositions(conn)
 	for i, torrentItem := range torrents {
-		translated := make(JsonMap)
-
-		hash := torrentItem.Hash
-		id := torrentItem.Id
-
-		MapTorrentList(translated, torrentItem) // TODO: Make it conditional too
-
-		if propsGeneralNeeded {
-			log.WithField("id", id).WithField("hash", hash).Debug("Props required")
-			propsCache.GetOrFill(hash, translated, severalIDsRequired, func(dest JsonMap) {
-				propGeneral := qBTConn.GetPropsGeneral(hash)
-				MapPropsGeneral(dest, propGeneral)
-				addPropertiesToCommentField(dest, torrentItem, propGeneral)
-			})
-		}
-		if trackersNeeded || trackerStatsNeeded {
-			log.WithField("id", id).WithField("hash", hash).Debug("Trackers required")
-			trackersCache.GetOrFill(hash, translated, severalIDsRequired, func(dest JsonMap) {
-				trackers := qBTConn.GetPropsTrackers(hash)
-				MapPropsTrackers(dest, trackers)
-				MapPropsTrackerStats(dest, trackers, torrentItem)
-			})
-		}
-		if piecesNeeded {
-			log.WithField("id", id).WithField("hash", hash).Debug("Pieces required")
-			pieces := qBTConn.GetPiecesStates(hash)
-			MapPieceStates(translated, pieces)
-		}
-		if filesNeeded {
-			log.WithField("id", id).WithField("hash", hash).Debug("Files required")
-			files := qBTConn.GetPropsFiles(hash)
-			MapPropsFiles(translated, files)
-		}
-		if peersNeeded {
-			log.WithField("id", id).WithField("hash", hash).Debug("Peers required")
-			MapPropsPeers(translated, hash)
-		}
-
-		translated["id"] = id
-		translated["queuePosition"] = i + 1
-		// TODO: Check it once
-		for _, field := range fields {
-			if _, ok := translated[field]; !ok {
-				if !IsFieldDeprecated(field) {
-					log.Error("Unsupported field: ", field)
-					panic("Unsupported field: " + field)
-				}
+		sources := newTorrentSources(conn, torrentItem, cacheAllowed, queue)
+		translated := make(JsonMap, len(fields))
+		for _, name := range fields {
+			value, err := sources.Value(name)
+			if err != nil {
+				return nil, err
 			}
+			translated[name] = value
 		}
-		for translatedField := range translated {
-			if !Any(fields, translatedField) {
-				// Remove unneeded fields
-				delete(translated, translatedField)
+		resultList[i] = translated
+	}
+	return resultList, nil
+}
+
+// In the table format, the first row contains field names and each following row holds values of one torrent
+func torrentTable(conn *qBT.Connection, torrents qBT.TorrentInfoList, fields []string, cacheAllowed bool) ([][]interface{}, error) {
+	table := make([][]interface{}, 0, len(torrents)+1)
+	header := make([]interface{}, len(fields))
+	for i, name := range fields {
+		header[i] = name
+	}
+	table = append(table, header)
+	queue := newQueuePositions(conn)
+	for _, torrentItem := range torrents {
+		sources := newTorrentSources(conn, torrentItem, cacheAllowed, queue)
+		row := make([]interface{}, len(fields))
+		for i, name := range fields {
+			value, err := sources.Value(name)
+			if err != nil {
+				return nil, err
 			}
+			row[i] = value
 		}
-		resultList[i] = translated
+		table = append(table, row)
 	}
-	response := JsonMap{"torrents": resultList}
-	addRemovedList(req.Ids, response)
-	return response, "success"
+	return table, nil
 }
 
-func addRemovedList(idsField *json.RawMessage, resp JsonMap) {
+func addRemovedList(idsField *json.RawMessage, resp JsonMap) error {
 	if idsField == nil {
-		return
+		return nil
 	}
 	var ids interface{}
-	err := json.Unmarshal(*idsField, &ids)
-	Check(err)
+	if err := json.Unmarshal(*idsField, &ids); err != nil {
+		return InvalidArgument("Invalid ids: %s", describeJSONError(err))
+	}
 
 	switch ids.(type) {
 	case string:
 		resp["removed"] = qBTConn.TorrentsList.GetRemoved()
 	}
+	return nil
 }
 
 func qBTEncryptionToTR(enc int) (res string) {
@@ -599,28 +734,45 @@ func qBTEncryptionToTR(enc int) (res string) {
 	}
 }
 
-func SessionGet() (JsonMap, string) {
+func SessionGet(conn *qBT.Connection) (JsonMap, error) {
 	session := make(JsonMap)
 	for key, value := range transmission.SessionGetBase {
 		session[key] = value
 	}
 
-	prefs := qBTConn.GetPreferences()
+	prefs, err := conn.GetPreferences()
+	if err != nil {
+		return nil, err
+	}
 	session["download-dir"] = prefs.Save_path
-	session["speed-limit-down"] = prefs.Dl_limit / 1024
-	session["speed-limit-up"] = prefs.Up_limit / 1024
-	if prefs.Dl_limit == -1 {
-		session["speed-limit-down-enabled"] = false
-	} else {
+	// qBittorrent reports -1 (or 0) for "no limit"
+	if prefs.Dl_limit > 0 {
 		session["speed-limit-down-enabled"] = true
+		session["speed-limit-down"] = prefs.Dl_limit / transmission.SpeedBytes
+	} else {
+		session["speed-limit-down-enabled"] = false
+		session["speed-limit-down"] = 0
 	}
 
-	if prefs.Up_limit == -1 {
-		session["speed-limit-up-enabled"] = false
-	} else {
+	if prefs.Up_limit > 0 {
 		session["speed-limit-up-enabled"] = true
+		session["speed-limit-up"] = prefs.Up_limit / transmission.SpeedBytes
+	} else {
+		session["speed-limit-up-enabled"] = false
+		session["speed-limit-up"] = 0
 	}
 
+	if session["alt-speed-enabled"], err = conn.GetSpeedLimitsMode(); err != nil {
+		return nil, err
+	}
+	session["alt-speed-down"] = prefs.Alt_dl_limit / transmission.SpeedBytes
+	session["alt-speed-up"] = prefs.Alt_up_limit / transmission.SpeedBytes
+
+	session["alt-speed-time-enabled"] = prefs.Scheduler_enabled
+	session["alt-speed-time-begin"] = prefs.Schedule_from_hour*60 + prefs.Schedule_from_min
+	session["alt-speed-time-end"] = prefs.Schedule_to_hour*60 + prefs.Schedule_to_min
+	session["alt-speed-time-day"] = qBTSchedulerDaysToTR(prefs.Scheduler_days)
+
 	session["peer-limit-global"] = prefs.Max_connec
 	session["peer-limit-per-torrent"] = prefs.Max_connec_per_torrent
 	session["peer-port"] = prefs.Listen_port
@@ -641,17 +793,244 @@ func SessionGet() (JsonMap, string) {
 	session["seed-queue-enabled"] = prefs.Queueing_enabled
 	session["download-dir"] = prefs.Save_path
 
-	version := qBTConn.GetVersion()
-	session["version"] = "2.94 (really qBT " + string(version) + ")"
-	return session, "success"
+	release := transmission.Releases[int(*rpcVersion)]
+	session["rpc-version"] = *rpcVersion
+	session["rpc-version-semver"] = release.SemVer
+	version, err := conn.GetVersion()
+	if err != nil {
+		return nil, err
+	}
+	session["version"] = release.Version + " (really qBT " + version + ")"
+
+	for field := range session {
+		if !transmission.IsFieldAvailable(transmission.SessionFieldVersions, field, int(*rpcVersion)) {
+			delete(session, field)
+		}
+	}
+	return session, nil
+}
+
+func trEncryptionToQBT(enc string) (int, error) {
+	switch enc {
+	case "preferred":
+		return 0, nil
+	case "required":
+		return 1, nil
+	case "tolerated":
+		// qBittorrent can't accept encrypted connections without preferring them, so "tolerated" (prefer
+		// unencrypted) disables encryption. It's also what "tolerated" is reported for in session-get.
+		return 2, nil
+	default:
+		return 0, errors.New("Unknown encryption mode: " + enc)
+	}
 }
 
-func FreeSpace(args json.RawMessage) (JsonMap, string) {
+// Transmission's alt-speed-time-day is a bitmask of days starting from Sunday
+const TR_SCHED_SUN = 1 << 0
+const TR_SCHED_WEEKDAY = 0x3E // Monday to Friday
+const TR_SCHED_WEEKEND = 0x41 // Saturday and Sunday
+const TR_SCHED_ALL = 0x7F
+
+// qBittorrent's scheduler days: 0 - every day, 1 - weekdays, 2 - weekends, 3 to 9 - Monday to Sunday
+const QBT_SCHED_EVERY_DAY = 0
+const QBT_SCHED_WEEKDAYS = 1
+const QBT_SCHED_WEEKENDS = 2
+const QBT_SCHED_MONDAY = 3
+const QBT_SCHED_SUNDAY = 9
+
+func qBTSchedulerDaysToTR(days int) int {
+	switch {
+	case days == QBT_SCHED_EVERY_DAY:
+		return TR_SCHED_ALL
+	case days == QBT_SCHED_WEEKDAYS:
+		return TR_SCHED_WEEKDAY
+	case days == QBT_SCHED_WEEKENDS:
+		return TR_SCHED_WEEKEND
+	case days == QBT_SCHED_SUNDAY:
+		return TR_SCHED_SUN
+	case days >= QBT_SCHED_MONDAY && days < QBT_SCHED_SUNDAY:
+		return TR_SCHED_SUN << uint(days-QBT_SCHED_MONDAY+1)
+	default:
+		return TR_SCHED_ALL
+	}
+}
+
+func trSchedulerDaysToQBT(days int) (int, error) {
+	switch days {
+	case TR_SCHED_ALL:
+		return QBT_SCHED_EVERY_DAY, nil
+	case TR_SCHED_WEEKDAY:
+		return QBT_SCHED_WEEKDAYS, nil
+	case TR_SCHED_WEEKEND:
+		return QBT_SCHED_WEEKENDS, nil
+	case TR_SCHED_SUN:
+		return QBT_SCHED_SUNDAY, nil
+	}
+	for day := QBT_SCHED_MONDAY; day < QBT_SCHED_SUNDAY; day++ {
+		if days == TR_SCHED_SUN<<uint(day-QBT_SCHED_MONDAY+1) {
+			return day, nil
+		}
+	}
+	return 0, errors.New("qBittorrent supports only every day, weekdays, weekends or a single day in a schedule")
+}
+
+// Session arguments which have a direct qBittorrent counterpart
+var sessionArgumentsToPreferences = map[string]string{
+	"download-dir":              "save_path",
+	"peer-limit-global":         "max_connec",
+	"peer-limit-per-torrent":    "max_connec_per_torrent",
+	"peer-port":                 "listen_port",
+	"seedRatioLimit":            "max_ratio",
+	"seedRatioLimited":          "max_ratio_enabled",
+	"peer-port-random-on-start": "random_port",
+	"port-forwarding-enabled":   "upnp",
+	"utp-enabled":               "enable_utp",
+	"dht-enabled":               "dht",
+	"incomplete-dir":            "temp_path",
+	"incomplete-dir-enabled":    "temp_path_enabled",
+	"lpd-enabled":               "lsd",
+	"pex-enabled":               "pex",
+	"download-queue-size":       "max_active_downloads",
+	"alt-speed-time-enabled":    "scheduler_enabled",
+	"seed-queue-size":           "max_active_uploads",
+}
+
+func SessionSet(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
+	var req map[string]interface{}
+	err := json.Unmarshal(args, &req)
+	if err != nil {
+		return nil, ArgumentError(err)
+	}
+
+	var limits struct {
+		SpeedLimitDown        *int        `json:"speed-limit-down"`
+		SpeedLimitDownEnabled interface{} `json:"speed-limit-down-enabled"`
+		SpeedLimitUp          *int        `json:"speed-limit-up"`
+		SpeedLimitUpEnabled   interface{} `json:"speed-limit-up-enabled"`
+	}
+	err = json.Unmarshal(args, &limits)
+	if err != nil {
+		return nil, InvalidArgument("Invalid speed limit: %s", describeJSONError(err))
+	}
+
+	// qBittorrent has a single queueing switch for both downloads and seeds
+	downloadQueue, hasDownloadQueue := req["download-queue-enabled"]
+	seedQueue, hasSeedQueue := req["seed-queue-enabled"]
+	if hasDownloadQueue && hasSeedQueue && parseBoolArgument(downloadQueue) != parseBoolArgument(seedQueue) {
+		return nil, InvalidArgument("qBittorrent can't enable download and seed queues separately")
+	}
+
+	var current JsonMap // Lazily filled, used to accept unsupported arguments which don't change anything
+	prefs := make(qBT.JsonMap)
+	var unsupported []string
+	for key, value := range req {
+		if qBTKey, ok := sessionArgumentsToPreferences[key]; ok {
+			prefs[qBTKey] = value
+			continue
+		}
+		switch key {
+		case "speed-limit-down", "speed-limit-down-enabled", "speed-limit-up", "speed-limit-up-enabled":
+			// Handled below
+		case "encryption":
+			encryption, _ := value.(string)
+			prefs["encryption"], err = trEncryptionToQBT(encryption)
+			if err != nil {
+				return nil, InvalidArgument("%v", err)
+			}
+		case "download-queue-enabled", "seed-queue-enabled":
+			prefs["queueing_enabled"] = parseBoolArgument(value)
+		case "alt-speed-down", "alt-speed-up":
+			limit, ok := value.(float64)
+			if !ok {
+				return nil, InvalidArgument("Invalid value of %s", key)
+			}
+			if key == "alt-speed-down" {
+				prefs["alt_dl_limit"] = int(limit) * transmission.SpeedBytes
+			} else {
+				prefs["alt_up_limit"] = int(limit) * transmission.SpeedBytes
+			}
+		case "alt-speed-enabled":
+			// Handled below
+		case "alt-speed-time-begin", "alt-speed-time-end":
+			minutes, ok := value.(float64)
+			if !ok || minutes < 0 || minutes >= 24*60 {
+				return nil, InvalidArgument("Invalid value of %s", key)
+			}
+			if key == "alt-speed-time-begin" {
+				prefs["schedule_from_hour"] = int(minutes) / 60
+				prefs["schedule_from_min"] = int(minutes) % 60
+			} else {
+				prefs["schedule_to_hour"] = int(minutes) / 60
+				prefs["schedule_to_min"] = int(minutes) % 60
+			}
+		case "alt-speed-time-day":
+			days, ok := value.(float64)
+			if !ok {
+				return nil, InvalidArgument("Invalid value of %s", key)
+			}
+			prefs["scheduler_days"], err = trSchedulerDaysToQBT(int(days))
+			if err != nil {
+				return nil, InvalidArgument("%v", err)
+			}
+		default:
+			if current == nil {
+				if current, err = SessionGet(conn); err != nil {
+					return nil, err
+				}
+			}
+			if !isSameJSONValue(current[key], value) {
+				unsupported = append(unsupported, key)
+			}
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		log.WithField("arguments", unsupported).Error("Unsupported session-set arguments")
+		return nil, InvalidArgument("Unsupported arguments: %s", strings.Join(unsupported, ", "))
+	}
+
+	if limit, ok := parseSpeedLimit(limits.SpeedLimitDown, limits.SpeedLimitDownEnabled); ok {
+		prefs["dl_limit"] = limit
+	}
+	if limit, ok := parseSpeedLimit(limits.SpeedLimitUp, limits.SpeedLimitUpEnabled); ok {
+		prefs["up_limit"] = limit
+	}
+
+	if len(prefs) > 0 {
+		log.WithField("preferences", prefs).Debug("Setting preferences")
+		if err := conn.SetPreferences(prefs); err != nil {
+			return nil, err
+		}
+	}
+
+	if altSpeedEnabled, ok := req["alt-speed-enabled"]; ok {
+		enabled, err := conn.GetSpeedLimitsMode()
+		if err != nil {
+			return nil, err
+		}
+		if parseBoolArgument(altSpeedEnabled) != enabled {
+			log.WithField("enabled", parseBoolArgument(altSpeedEnabled)).Info("Toggling alternative speed limits")
+			if err := conn.ToggleSpeedLimitsMode(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return JsonMap{}, nil
+}
+
+func isSameJSONValue(a, b interface{}) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+func FreeSpace(args json.RawMessage) (JsonMap, error) {
 	req := struct {
 		Path string
 	}{}
-	err := json.Unmarshal(args, &req)
-	Check(err)
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, ArgumentError(err)
+	}
 
 	diskUsage := du.NewDiskUsage(req.Path)
 	freeSpace := diskUsage.Available()
@@ -661,16 +1040,16 @@ func FreeSpace(args json.RawMessage) (JsonMap, string) {
 	return JsonMap{
 		"path":       req.Path,
 		"size-bytes": freeSpace,
-	}, "success"
+	}, nil
 }
 
-func SessionStats() (JsonMap, string) {
+func SessionStats(conn *qBT.Connection) (JsonMap, error) {
 	session := make(JsonMap)
 	for key, value := range transmission.SessionStatsTemplate {
 		session[key] = value
 	}
 
-	torrentList := qBTConn.TorrentsList.AllItems()
+	torrentList := conn.TorrentsList.AllItems()
 
 	paused := 0
 	active := 0
@@ -685,7 +1064,10 @@ func SessionStats() (JsonMap, string) {
 		}
 	}
 
-	info := qBTConn.GetTransferInfo()
+	info, err := conn.GetTransferInfo()
+	if err != nil {
+		return nil, err
+	}
 	session["activeTorrentCount"] = active
 	session["pausedTorrentCount"] = paused
 	session["torrentCount"] = all
@@ -695,41 +1077,142 @@ func SessionStats() (JsonMap, string) {
 	session["current-stats"].(map[string]int64)["uploadedBytes"] = info.Up_info_data
 	session["current-stats"].(map[string]int64)["secondsActive"] = int64(timeElapsed)
 	session["cumulative-stats"] = session["current-stats"]
-	return session, "success"
+	return session, nil
 }
 
-func TorrentPause(args json.RawMessage) (JsonMap, string) {
-	torrents := parseActionArgument(args)
+func TorrentPause(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
+	torrents, err := parseActionArgument(conn, args)
+	if err != nil {
+		return nil, err
+	}
 	log.WithField("hashes", torrents.Hashes()).Debug("Stopping torrents")
-	qBTConn.PostWithHashes("torrents/pause", torrents)
-	return JsonMap{}, "success"
+	return JsonMap{}, conn.PostWithHashes("torrents/pause", torrents)
 }
 
-func TorrentResume(args json.RawMessage) (JsonMap, string) {
-	torrents := parseActionArgument(args)
+func TorrentResume(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
+	torrents, err := parseActionArgument(conn, args)
+	if err != nil {
+		return nil, err
+	}
 	log.WithField("hashes", torrents.Hashes()).Debug("Starting torrents")
 
-	qBTConn.PostWithHashes("torrents/resume", torrents)
-	return JsonMap{}, "success"
+	if err := conn.PostWithHashes("torrents/resume", torrents); err != nil {
+		return nil, err
+	}
+
+	forced := make(qBT.TorrentInfoList, 0)
+	for _, torrent := range torrents {
+		if torrent.Force_start {
+			forced = append(forced, torrent)
+		}
+	}
+	if len(forced) > 0 {
+		log.WithField("hashes", forced.Hashes()).Debug("Clearing force start")
+		if err := conn.SetForceStart(forced, false); err != nil {
+			return nil, err
+		}
+	}
+	return JsonMap{}, nil
+}
+
+func TorrentStartNow(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
+	torrents, err := parseActionArgument(conn, args)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("hashes", torrents.Hashes()).Debug("Force starting torrents")
+
+	return JsonMap{}, conn.SetForceStart(torrents, true)
+}
+
+func QueueMove(conn *qBT.Connection, args json.RawMessage, path string) (JsonMap, error) {
+	torrents, err := parseActionArgument(conn, args)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("hashes", torrents.Hashes()).WithField("action", path).Debug("Moving torrents in the queue")
+
+	return JsonMap{}, conn.PostWithHashes(path, torrents)
+}
+
+// Transmission doesn't allow manual announces more often than once a minute
+const MANUAL_ANNOUNCE_INTERVAL = 60 * time.Second
+
+// ManualAnnounceTimes keeps the times when a manual announce is allowed again.
+// Expired times are dropped, so only torrents announced within MANUAL_ANNOUNCE_INTERVAL are kept.
+type ManualAnnounceTimes struct {
+	times map[qBT.Hash]int64
+	lock  sync.Mutex
+}
+
+func (m *ManualAnnounceTimes) Get(hash qBT.Hash) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	announceTime, exists := m.times[hash]
+	if exists && announceTime <= time.Now().Unix() {
+		delete(m.times, hash)
+		return 0
+	}
+	return announceTime
+}
+
+func (m *ManualAnnounceTimes) Announced(torrents qBT.TorrentInfoList) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.times == nil {
+		m.times = make(map[qBT.Hash]int64)
+	}
+	now := time.Now()
+	for hash, announceTime := range m.times {
+		if announceTime <= now.Unix() {
+			delete(m.times, hash)
+		}
+	}
+	nextAnnounce := now.Add(MANUAL_ANNOUNCE_INTERVAL).Unix()
+	for _, torrent := range torrents {
+		m.times[torrent.Hash] = nextAnnounce
+	}
+}
+
+var manualAnnounces ManualAnnounceTimes
+
+func TorrentReannounce(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
+	torrents, err := parseActionArgument(conn, args)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("hashes", torrents.Hashes()).Debug("Reannouncing torrents")
+
+	if err := conn.PostWithHashes("torrents/reannounce", torrents); err != nil {
+		return nil, err
+	}
+	manualAnnounces.Announced(torrents)
+	return JsonMap{}, nil
 }
 
-func TorrentRecheck(args json.RawMessage) (JsonMap, string) {
-	torrents := parseActionArgument(args)
+func TorrentRecheck(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
+	torrents, err := parseActionArgument(conn, args)
+	if err != nil {
+		return nil, err
+	}
 	log.WithField("hashes", torrents.Hashes()).Debug("Verifying torrents")
 
-	qBTConn.PostWithHashes("torrents/recheck", torrents)
-	return JsonMap{}, "success"
+	return JsonMap{}, conn.PostWithHashes("torrents/recheck", torrents)
 }
 
-func TorrentDelete(args json.RawMessage) (JsonMap, string) {
+func TorrentDelete(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
 	var req struct {
-		Ids             json.RawMessage
+		Ids             *json.RawMessage
 		DeleteLocalData interface{} `json:"delete-local-data"`
 	}
-	err := json.Unmarshal(args, &req)
-	Check(err)
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, ArgumentError(err)
+	}
 
-	torrents := parseIDsField(&req.Ids)
+	torrents, err := parseIDsField(conn, req.Ids)
+	if err != nil {
+		return nil, err
+	}
 	log.WithField("hashes", torrents.Hashes()).Warn("Going to remove torrents")
 
 	joinedHashes := torrents.ConcatenateHashes()
@@ -745,14 +1228,20 @@ func TorrentDelete(args json.RawMessage) (JsonMap, string) {
 		log.Info("Going to remove torrents: ", joinedHashes)
 		params["deleteFiles"] = "false"
 	}
-	url := qBTConn.MakeRequestURLWithParam("torrents/delete", params)
-	qBTConn.DoGET(url)
+	url := conn.MakeRequestURLWithParam("torrents/delete", params)
+	if _, err := conn.DoGET(url); err != nil {
+		return nil, err
+	}
 
-	return JsonMap{}, "success"
+	return JsonMap{}, nil
 }
 
 func parseDeleteFilesField(deleteLocalData interface{}) bool {
-	switch val := deleteLocalData.(type) {
+	return parseBoolArgument(deleteLocalData)
+}
+
+func parseBoolArgument(value interface{}) bool {
+	switch val := value.(type) {
 	case bool:
 		return val
 	case float64:
@@ -782,7 +1271,14 @@ func AdditionalArgumentToString(value argumentValue) string {
 	}
 }
 
-func UploadTorrent(metainfo *[]byte, urls *string, req *transmission.TorrentAddRequest, paused bool) {
+func boolToArgument(value bool) argumentValue {
+	if value {
+		return ARGUMENT_TRUE
+	}
+	return ARGUMENT_FALSE
+}
+
+func UploadTorrent(conn *qBT.Connection, metainfo *[]byte, urls *string, req *transmission.TorrentAddRequest, paused bool) error {
 	var buffer bytes.Buffer
 	mime := multipart.NewWriter(&buffer)
 
@@ -794,18 +1290,30 @@ func UploadTorrent(metainfo *[]byte, urls *string, req *transmission.TorrentAddR
 
 	if urls != nil {
 		PutMIMEField(mime, "urls", *urls)
+		if req.HasFileSelections() {
+			// Files are unknown until the metadata is fetched, so stop right after that
+			stopConditionSupported, err := conn.VersionAtLeast(4, 5)
+			if err != nil {
+				return err
+			}
+			if stopConditionSupported {
+				PutMIMEField(mime, "stopCondition", "MetadataReceived")
+			} else {
+				log.Warn("qBittorrent before 4.5 can't stop a magnet link after fetching metadata, " +
+					"unwanted files may be partially downloaded before file selections are applied")
+			}
+		}
 	}
 
+	sequentialDownload := ARGUMENT_NOT_SET
 	if req.Download_dir != nil {
 		extraArgs, strippedLocation, err := parseAdditionalLocationArguments(*req.Download_dir)
-		Check(err)
+		if err != nil {
+			return InvalidArgument("Invalid download-dir: %v", err)
+		}
 		log.Debug("Stripped location is ", strippedLocation)
 
-		if extraArgs.sequentialDownload != ARGUMENT_NOT_SET {
-			log.Debug("Sequential download: ", AdditionalArgumentToString(extraArgs.sequentialDownload))
-			PutMIMEField(mime, "sequentialDownload",
-				AdditionalArgumentToString(extraArgs.sequentialDownload))
-		}
+		sequentialDownload = extraArgs.sequentialDownload
 
 		if extraArgs.firstLastPiecesFirst != ARGUMENT_NOT_SET {
 			log.Debug("FirstLastPiecePrio: ", AdditionalArgumentToString(extraArgs.firstLastPiecesFirst))
@@ -822,6 +1330,15 @@ func UploadTorrent(metainfo *[]byte, urls *string, req *transmission.TorrentAddR
 		PutMIMEField(mime, "savepath", strippedLocation)
 	}
 
+	// The sequential_download argument takes precedence over the download-dir suffix
+	if req.Sequential_download != nil {
+		sequentialDownload = boolToArgument(*req.Sequential_download)
+	}
+	if sequentialDownload != ARGUMENT_NOT_SET {
+		log.Debug("Sequential download: ", AdditionalArgumentToString(sequentialDownload))
+		PutMIMEField(mime, "sequentialDownload", AdditionalArgumentToString(sequentialDownload))
+	}
+
 	pausedWriter, err := mime.CreateFormField("paused")
 	Check(err)
 	if paused {
@@ -834,17 +1351,25 @@ func UploadTorrent(metainfo *[]byte, urls *string, req *transmission.TorrentAddR
 
 	mime.Close()
 
-	qBTConn.DoPOST(qBTConn.MakeRequestURL("torrents/add"), mime.FormDataContentType(), &buffer)
+	if _, err := conn.DoPOST(conn.MakeRequestURL("torrents/add"), mime.FormDataContentType(), &buffer); err != nil {
+		return err
+	}
 	log.Debug("Torrent uploaded")
+	return nil
 }
 
-func ParseMagnetLink(link string) (newHash qBT.Hash, newName string) {
+func ParseMagnetLink(link string) (newHash qBT.Hash, newName string, err error) {
 	path := strings.TrimPrefix(link, "magnet:?")
 	params, err := url.ParseQuery(path)
-	Check(err)
+	if err != nil {
+		return "", "", InvalidArgument("Invalid magnet link: %v", err)
+	}
 	log.WithFields(log.Fields{
 		"params": params,
 	}).Debug("Params decoded")
+	if len(params["xt"]) == 0 {
+		return "", "", InvalidArgument("Invalid magnet link: %s", link)
+	}
 	trimmed := strings.TrimPrefix(params["xt"][0], "urn:btih:")
 	newHash = qBT.Hash(strings.ToLower(trimmed))
 	name, nameProvided := params["dn"]
@@ -856,9 +1381,11 @@ func ParseMagnetLink(link string) (newHash qBT.Hash, newName string) {
 	return
 }
 
-func ParseMetainfo(metainfo []byte) (newHash qBT.Hash, newName string) {
+func ParseMetainfo(metainfo []byte) (newHash qBT.Hash, newName string, err error) {
 	var parsedMetaInfo MetaInfo
-	parsedMetaInfo.ReadTorrentMetaInfoFile(bytes.NewBuffer(metainfo))
+	if !parsedMetaInfo.ReadTorrentMetaInfoFile(bytes.NewBuffer(metainfo)) {
+		return "", "", InvalidArgument("invalid or corrupt torrent file")
+	}
 
 	log.WithFields(log.Fields{
 		"len":  len(metainfo),
@@ -870,12 +1397,19 @@ func ParseMetainfo(metainfo []byte) (newHash qBT.Hash, newName string) {
 	return
 }
 
-func TorrentAdd(args json.RawMessage) (JsonMap, string) {
+func TorrentAdd(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
 	var req transmission.TorrentAddRequest
-	err := json.Unmarshal(args, &req)
-	Check(err)
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, ArgumentError(err)
+	}
 
-	qBTConn.UpdateTorrentsList()
+	if err := conn.UpdateTorrentsList(); err != nil {
+		return nil, err
+	}
+
+	if req.Metainfo == nil && req.Filename == nil {
+		return nil, InvalidArgument("no filename or metainfo specified")
+	}
 
 	var newHash qBT.Hash
 	var newName string
@@ -892,23 +1426,47 @@ func TorrentAdd(args json.RawMessage) (JsonMap, string) {
 		}
 	}
 
+	// Add torrents with file selections paused, so that no unwanted data is downloaded
+	pausedOnAdd := paused || req.HasFileSelections()
+	isMagnet := false
+
+	var err error
 	if req.Metainfo != nil {
 		log.Debug("Upload torrent from metainfo")
 		metainfo, err := base64.StdEncoding.DecodeString(*req.Metainfo)
-		Check(err)
-		newHash, newName = ParseMetainfo(metainfo)
-		UploadTorrent(&metainfo, nil, &req, paused)
+		if err != nil {
+			return nil, InvalidArgument("Invalid metainfo: %v", err)
+		}
+		if newHash, newName, err = ParseMetainfo(metainfo); err != nil {
+			return nil, err
+		}
+		if err = UploadTorrent(conn, &metainfo, nil, &req, pausedOnAdd); err != nil {
+			return nil, err
+		}
 	} else if req.Filename != nil {
 		path := *req.Filename
 		if strings.HasPrefix(path, "magnet:?") {
-			newHash, newName = ParseMagnetLink(path)
+			if newHash, newName, err = ParseMagnetLink(path); err != nil {
+				return nil, err
+			}
+			isMagnet = true
 
-			UploadTorrent(nil, &path, &req, paused)
+			// Paused magnets never get metadata, UploadTorrent sets a stop condition instead
+			if err = UploadTorrent(conn, nil, &path, &req, paused && !req.HasFileSelections()); err != nil {
+				return nil, err
+			}
 		} else if strings.HasPrefix(path, "http") {
-			metainfo := DoGetWithCookies(path, req.Cookies)
+			metainfo, err := DoGetWithCookies(path, req.Cookies)
+			if err != nil {
+				return nil, err
+			}
 
-			newHash, newName = ParseMetainfo(metainfo)
-			UploadTorrent(&metainfo, nil, &req, paused)
+			if newHash, newName, err = ParseMetainfo(metainfo); err != nil {
+				return nil, err
+			}
+			if err = UploadTorrent(conn, &metainfo, nil, &req, pausedOnAdd); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -917,21 +1475,23 @@ func TorrentAdd(args json.RawMessage) (JsonMap, string) {
 		"name": newName,
 	}).Debug("Attempting to add torrent")
 
-	if torrent := qBTConn.TorrentsList.ByHash(newHash); torrent != nil {
+	if torrent := conn.TorrentsList.ByHash(newHash); torrent != nil {
 		return JsonMap{
 			"torrent-duplicate": JsonMap{
 				"id":         torrent.Id,
 				"name":       newName,
 				"hashString": newHash,
 			},
-		}, "success"
+		}, nil
 	}
 
 	var torrent *qBT.TorrentInfo
 	for retries := 0; retries < 100; retries++ {
 		time.Sleep(50 * time.Millisecond)
-		qBTConn.UpdateTorrentsList()
-		torrent = qBTConn.TorrentsList.ByHash(newHash)
+		if err := conn.UpdateTorrentsList(); err != nil {
+			return nil, err
+		}
+		torrent = conn.TorrentsList.ByHash(newHash)
 		if torrent != nil {
 			log.Debug("Found ID ", torrent.Id)
 			break
@@ -941,7 +1501,7 @@ func TorrentAdd(args json.RawMessage) (JsonMap, string) {
 	}
 
 	if torrent == nil {
-		return JsonMap{}, "Torrent-add timeout"
+		return nil, InvalidArgument("Torrent-add timeout")
 	}
 
 	log.WithFields(log.Fields{
@@ -950,60 +1510,472 @@ func TorrentAdd(args json.RawMessage) (JsonMap, string) {
 		"name": newName,
 	}).Debug("New torrent")
 
+	if req.Peer_limit != nil || req.BandwidthPriority != nil {
+		log.WithField("hash", newHash).Info("qBittorrent doesn't support per-torrent peer limit and bandwidth priority, ignoring")
+	}
+
+	if req.HasFileSelections() {
+		if isMagnet {
+			go applyFileSelectionsAfterMetadata(conn, newHash, &req, paused)
+		} else if err := applyFileSelections(conn, newHash, &req, paused); err != nil {
+			return nil, err
+		}
+	}
+
 	return JsonMap{
 		"torrent-added": JsonMap{
 			"id":         torrent.Id,
 			"name":       newName,
 			"hashString": newHash,
 		},
-	}, "success"
+	}, nil
+}
+
+// A variable, so that tests don't have to wait
+var METADATA_WAIT_INTERVAL = 1 * time.Second
+
+const METADATA_WAIT_RETRIES = 600
+
+func applyFileSelections(conn *qBT.Connection, hash qBT.Hash, req *transmission.TorrentAddRequest, paused bool) error {
+	log.WithField("hash", hash).Debug("Applying file selections of the added torrent")
+	err := setFilesPriorities(conn, hash, req.Files_wanted, req.Files_unwanted,
+		req.Priority_high, req.Priority_low, req.Priority_normal)
+	if err != nil {
+		return err
+	}
+
+	torrents := qBT.TorrentInfoList{&qBT.TorrentInfo{Hash: hash}}
+	if paused {
+		return conn.PostWithHashes("torrents/pause", torrents)
+	} else {
+		return conn.PostWithHashes("torrents/resume", torrents)
+	}
+}
+
+func applyFileSelectionsAfterMetadata(conn *qBT.Connection, hash qBT.Hash, req *transmission.TorrentAddRequest, paused bool) {
+	for retries := 0; retries < METADATA_WAIT_RETRIES; retries++ {
+		files, err := conn.GetPropsFiles(hash)
+		if _, isRequestError := err.(*qBT.RequestError); isRequestError {
+			// qBittorrent may be restarting or may not know about the torrent yet
+			log.WithField("hash", hash).Debug("Can't get files, retrying: ", err)
+		} else if err != nil {
+			log.WithField("hash", hash).Error("Can't apply file selections: ", err)
+			return
+		} else if len(files) > 0 {
+			if err := applyFileSelections(conn, hash, req, paused); err != nil {
+				log.WithField("hash", hash).Error("Can't apply file selections: ", err)
+			}
+			return
+		}
+		time.Sleep(METADATA_WAIT_INTERVAL)
+	}
+	log.WithField("hash", hash).Error("Metadata wasn't received in time, file selections are lost")
 }
 
-func TorrentSet(args json.RawMessage) (JsonMap, string) {
+func TorrentSet(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
 	var req struct {
-		Ids            *json.RawMessage
-		Files_wanted   *[]int `json:"files-wanted"`
-		Files_unwanted *[]int `json:"files-unwanted"`
+		Ids                 *json.RawMessage
+		Files_wanted        *[]int        `json:"files-wanted"`
+		Files_unwanted      *[]int        `json:"files-unwanted"`
+		Priority_high       *[]int        `json:"priority-high"`
+		Priority_low        *[]int        `json:"priority-low"`
+		Priority_normal     *[]int        `json:"priority-normal"`
+		UploadLimit         *int          `json:"uploadLimit"`
+		UploadLimited       interface{}   `json:"uploadLimited"`
+		DownloadLimit       *int          `json:"downloadLimit"`
+		DownloadLimited     interface{}   `json:"downloadLimited"`
+		HonorsSessionLimits interface{}   `json:"honorsSessionLimits"`
+		SeedRatioLimit      *float64      `json:"seedRatioLimit"`
+		SeedRatioMode       *int          `json:"seedRatioMode"`
+		SeedIdleLimit       *float64      `json:"seedIdleLimit"`
+		SeedIdleMode        *int          `json:"seedIdleMode"`
+		TrackerAdd          []string      `json:"trackerAdd"`
+		TrackerRemove       []int         `json:"trackerRemove"`
+		TrackerReplace      []interface{} `json:"trackerReplace"`
+		TrackerList         *string       `json:"trackerList"`
+		Name                *string       `json:"name"`
+		SequentialDownload  *bool         `json:"sequential_download"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, ArgumentError(err)
+	}
+
+	torrents, err := parseIDsField(conn, req.Ids)
+	if err != nil {
+		return nil, err
 	}
-	err := json.Unmarshal(args, &req)
-	Check(err)
 
-	if req.Files_wanted != nil || req.Files_unwanted != nil {
-		torrents := parseIDsField(req.Ids)
-		if len(torrents) != 1 {
-			log.Error("Unsupported torrent-set request")
-			return JsonMap{}, "Unsupported torrent-set request"
+	// Validate arguments before changing anything
+	filesChanged := req.Files_wanted != nil || req.Files_unwanted != nil ||
+		req.Priority_high != nil || req.Priority_low != nil || req.Priority_normal != nil
+	if filesChanged && len(torrents) != 1 {
+		return nil, InvalidArgument("Files can be changed only in a single torrent")
+	}
+	if req.Name != nil && len(torrents) != 1 {
+		return nil, InvalidArgument("Only a single torrent can be renamed")
+	}
+
+	if filesChanged {
+		err := setFilesPriorities(conn, torrents[0].Hash, req.Files_wanted, req.Files_unwanted,
+			req.Priority_high, req.Priority_low, req.Priority_normal)
+		if err != nil {
+			return nil, err
 		}
-		torrent := torrents[0]
+	}
 
-		newFilesPriorities := make(map[int]int)
-		if req.Files_wanted != nil {
-			wanted := *req.Files_wanted
-			for _, fileId := range wanted {
-				newFilesPriorities[fileId] = 1 // Normal priority
+	limitsChanged := false
+	// Limits of some torrents could have been changed before an error
+	defer func() {
+		if limitsChanged {
+			for _, torrent := range torrents {
+				propsCache.Invalidate(torrent.Hash)
 			}
 		}
-		if req.Files_unwanted != nil {
-			unwanted := *req.Files_unwanted
-			for _, fileId := range unwanted {
-				newFilesPriorities[fileId] = 0 // Do not download
+	}()
+	if limit, ok := parseSpeedLimit(req.UploadLimit, req.UploadLimited); ok {
+		log.WithField("hashes", torrents.Hashes()).WithField("limit", limit).Debug("New upload limit")
+		limitsChanged = true
+		if err := conn.SetUploadLimit(torrents, limit); err != nil {
+			return nil, err
+		}
+	}
+	if limit, ok := parseSpeedLimit(req.DownloadLimit, req.DownloadLimited); ok {
+		log.WithField("hashes", torrents.Hashes()).WithField("limit", limit).Debug("New download limit")
+		limitsChanged = true
+		if err := conn.SetDownloadLimit(torrents, limit); err != nil {
+			return nil, err
+		}
+	}
+	if req.HonorsSessionLimits != nil && !parseBoolArgument(req.HonorsSessionLimits) {
+		log.Warn("qBittorrent doesn't support ignoring session limits per torrent, honorsSessionLimits is ignored")
+	}
+
+	if req.SeedRatioLimit != nil || req.SeedRatioMode != nil || req.SeedIdleLimit != nil || req.SeedIdleMode != nil {
+		for _, torrent := range torrents {
+			ratioLimit := trShareLimitToQBT(torrent.Ratio_limit, torrent.Max_ratio, req.SeedRatioMode, req.SeedRatioLimit)
+			currentIdleLimit, effectiveIdleLimit := idleSeedingLimit(torrent)
+			idleLimit := int64(trShareLimitToQBT(float64(currentIdleLimit), float64(effectiveIdleLimit),
+				req.SeedIdleMode, req.SeedIdleLimit))
+			if ratioLimit == torrent.Ratio_limit && idleLimit == currentIdleLimit {
+				continue
+			}
+			seedingTimeLimit, inactiveSeedingTimeLimit := torrent.Seeding_time_limit, int64(QBT_SHARE_LIMIT_GLOBAL)
+			if torrent.Inactive_seeding_time_limit != nil {
+				inactiveSeedingTimeLimit = idleLimit
+			} else {
+				seedingTimeLimit = idleLimit
+			}
+			log.WithFields(log.Fields{
+				"hash":                     torrent.Hash,
+				"ratioLimit":               ratioLimit,
+				"seedingTimeLimit":         seedingTimeLimit,
+				"inactiveSeedingTimeLimit": inactiveSeedingTimeLimit,
+			}).Debug("New share limits")
+			if err := conn.SetShareLimits(torrent.Hash, ratioLimit, seedingTimeLimit, inactiveSeedingTimeLimit); err != nil {
+				return nil, err
 			}
 		}
-		log.WithFields(log.Fields{
-			"priorities": newFilesPriorities,
-		}).Debug("New files priorities")
+	}
+
+	if req.TrackerAdd != nil || req.TrackerRemove != nil || req.TrackerReplace != nil || req.TrackerList != nil {
+		replacements, err := parseTrackerReplace(req.TrackerReplace)
+		if err != nil {
+			return nil, InvalidArgument("%v", err)
+		}
+		for _, torrent := range torrents {
+			err := editTrackers(conn, torrent.Hash, req.TrackerAdd, req.TrackerRemove, replacements, req.TrackerList)
+			trackersCache.Invalidate(torrent.Hash)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if req.Name != nil {
+		log.WithField("hash", torrents[0].Hash).WithField("name", *req.Name).Info("Renaming torrent")
+		err := conn.RenameTorrent(torrents[0].Hash, *req.Name)
+		invalidateRenamedTorrent(torrents[0].Hash)
+		if err != nil {
+			if isConflict(err) {
+				return nil, InvalidArgument("Invalid torrent name: %s", *req.Name)
+			}
+			return nil, err
+		}
+	}
+
+	if req.SequentialDownload != nil {
+		for _, torrent := range torrents {
+			if err := conn.SetSequentialDownload(torrent.Hash, *req.SequentialDownload); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return JsonMap{}, nil
+}
+
+type trackerReplacement struct {
+	id  int
+	url string
+}
+
+// parseTrackerReplace parses trackerReplace, which is a flat list of (ID, URL) pairs
+func parseTrackerReplace(pairs []interface{}) (replacements []trackerReplacement, err error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("Invalid trackerReplace argument")
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		id, idOk := pairs[i].(float64)
+		newUrl, urlOk := pairs[i+1].(string)
+		if !idOk || !urlOk {
+			return nil, errors.New("Invalid trackerReplace argument")
+		}
+		replacements = append(replacements, trackerReplacement{id: int(id), url: newUrl})
+	}
+	return
+}
+
+func editTrackers(conn *qBT.Connection, hash qBT.Hash, add []string, remove []int, replace []trackerReplacement, list *string) error {
+	trackers, err := conn.GetPropsTrackers(hash)
+	if err != nil {
+		return err
+	}
+	urlsByID := make(map[int]string)
+	for _, tracker := range trackers {
+		if !isPseudoTracker(tracker.Url) {
+			urlsByID[trackerID(tracker.Url)] = tracker.Url
+		}
+	}
+
+	if list != nil {
+		// trackerList replaces all trackers: one URL per line, tiers are separated by blank lines
+		newUrls := make(map[string]bool)
+		for _, line := range strings.Split(*list, "\n") {
+			if trackerUrl := strings.TrimSpace(line); trackerUrl != "" {
+				newUrls[trackerUrl] = true
+			}
+		}
+		for id, trackerUrl := range urlsByID {
+			if newUrls[trackerUrl] {
+				delete(newUrls, trackerUrl)
+			} else {
+				remove = append(remove, id)
+			}
+		}
+		for trackerUrl := range newUrls {
+			add = append(add, trackerUrl)
+		}
+	}
+
+	for _, replacement := range replace {
+		if origUrl, ok := urlsByID[replacement.id]; ok {
+			log.WithField("hash", hash).WithField("from", origUrl).WithField("to", replacement.url).Info("Replacing tracker")
+			if err := conn.EditTracker(hash, origUrl, replacement.url); err != nil {
+				if isConflict(err) {
+					return InvalidArgument("Can't replace tracker %s with %s, which is already in the list", origUrl, replacement.url)
+				}
+				return err
+			}
+		} else {
+			log.WithField("hash", hash).WithField("id", replacement.id).Warn("Unknown tracker ID")
+		}
+	}
+
+	removedUrls := make([]string, 0, len(remove))
+	for _, id := range remove {
+		if trackerUrl, ok := urlsByID[id]; ok {
+			removedUrls = append(removedUrls, trackerUrl)
+		} else {
+			log.WithField("hash", hash).WithField("id", id).Warn("Unknown tracker ID")
+		}
+	}
+	if len(removedUrls) > 0 {
+		log.WithField("hash", hash).WithField("urls", removedUrls).Info("Removing trackers")
+		if err := conn.RemoveTrackers(hash, removedUrls); err != nil {
+			return err
+		}
+	}
+
+	if len(add) > 0 {
+		log.WithField("hash", hash).WithField("urls", add).Info("Adding trackers")
+		return conn.AddTrackers(hash, add)
+	}
+	return nil
+}
+
+// setFilesPriorities applies Transmission's wanted flags and priorities, which are independent,
+// to qBittorrent's single file priority. An empty list means "all files".
+func setFilesPriorities(conn *qBT.Connection, hash qBT.Hash, filesWanted, filesUnwanted, priorityHigh, priorityLow, priorityNormal *[]int) error {
+	files, err := conn.GetPropsFiles(hash)
+	if err != nil {
+		return err
+	}
+	fileNum := len(files)
+
+	wanted := make([]bool, fileNum)
+	priorities := make([]int, fileNum)
+	touched := make([]bool, fileNum)
+	for i, file := range files {
+		wanted[i] = file.Priority != QBT_FILE_PRIORITY_SKIP
+		priorities[i] = qBTFilePriorityToTR(file.Priority)
+	}
 
-		for fileId, priority := range newFilesPriorities {
-			params := url.Values{
-				"hash":     {string(torrent.Hash)},
-				"id":       {strconv.Itoa(fileId)},
-				"priority": {strconv.Itoa(priority)},
+	forEachFile := func(indices *[]int, apply func(fileId int)) {
+		if indices == nil {
+			return
+		}
+		if len(*indices) == 0 {
+			for fileId := 0; fileId < fileNum; fileId++ {
+				apply(fileId)
+				touched[fileId] = true
+			}
+			return
+		}
+		for _, fileId := range *indices {
+			if fileId < 0 || fileId >= fileNum {
+				log.WithField("hash", hash).WithField("file", fileId).Warn("Invalid file index")
+				continue
+			}
+			apply(fileId)
+			touched[fileId] = true
+		}
+	}
+	forEachFile(filesWanted, func(fileId int) { wanted[fileId] = true })
+	forEachFile(filesUnwanted, func(fileId int) { wanted[fileId] = false })
+	forEachFile(priorityHigh, func(fileId int) { priorities[fileId] = TR_PRI_HIGH })
+	forEachFile(priorityLow, func(fileId int) { priorities[fileId] = TR_PRI_LOW })
+	forEachFile(priorityNormal, func(fileId int) { priorities[fileId] = TR_PRI_NORMAL })
+
+	newFilesPriorities := make(map[int]int)
+	for i, file := range files {
+		if !touched[i] {
+			continue
+		}
+		newPriority := QBT_FILE_PRIORITY_SKIP
+		if wanted[i] {
+			if file.Priority != QBT_FILE_PRIORITY_SKIP && priorities[i] == qBTFilePriorityToTR(file.Priority) {
+				continue // Keep qBittorrent-specific priorities such as "maximal"
 			}
-			qBTConn.PostForm(qBTConn.MakeRequestURL("torrents/filePrio"), params)
+			newPriority = trFilePriorityToQBT(priorities[i])
+		}
+		if newPriority != file.Priority {
+			newFilesPriorities[i] = newPriority
+		}
+	}
+	log.WithFields(log.Fields{
+		"priorities": newFilesPriorities,
+	}).Debug("New files priorities")
+
+	for fileId, priority := range newFilesPriorities {
+		params := url.Values{
+			"hash":     {string(hash)},
+			"id":       {strconv.Itoa(fileId)},
+			"priority": {strconv.Itoa(priority)},
+		}
+		if _, err := conn.PostForm(conn.MakeRequestURL("torrents/filePrio"), params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSpeedLimit converts Transmission's limit (KB/s) and "limited" flag into a qBittorrent limit (bytes/s).
+// qBittorrent has no separate flag, so disabling a limit sets it to 0 (unlimited).
+func parseSpeedLimit(limit *int, limited interface{}) (newLimit int, changed bool) {
+	if limited != nil && !parseBoolArgument(limited) {
+		return 0, true
+	}
+	if limit != nil {
+		return *limit * transmission.SpeedBytes, true
+	}
+	if limited != nil {
+		log.Debug("Speed limit was enabled without a value, ignoring")
+	}
+	return 0, false
+}
+
+func TorrentRenamePath(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
+	var req struct {
+		Ids  *json.RawMessage
+		Path string `json:"path"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, ArgumentError(err)
+	}
+
+	torrents, err := parseIDsField(conn, req.Ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(torrents) != 1 {
+		return nil, InvalidArgument("torrent-rename-path requires exactly one torrent")
+	}
+	torrent := torrents[0]
+
+	oldPath := strings.Trim(req.Path, "/")
+	if oldPath == "" || req.Name == "" || strings.Contains(req.Name, "/") || req.Name == "." || req.Name == ".." {
+		return nil, InvalidArgument("Invalid argument")
+	}
+	newPath := req.Name
+	if dir := path.Dir(oldPath); dir != "." {
+		newPath = dir + "/" + req.Name
+	}
+
+	isFile := false
+	isFolder := false
+	fileId := 0
+	files, err := conn.GetPropsFiles(torrent.Hash)
+	if err != nil {
+		return nil, err
+	}
+	for i, file := range files {
+		if file.Name == oldPath {
+			isFile = true
+			fileId = i
+		} else if strings.HasPrefix(file.Name, oldPath+"/") {
+			isFolder = true
+		}
+	}
+
+	logger := log.WithField("hash", torrent.Hash).WithField("from", oldPath).WithField("to", newPath)
+	// Something could have been renamed before an error
+	defer invalidateRenamedTorrent(torrent.Hash)
+	switch {
+	case isFile:
+		logger.Info("Renaming file")
+		err = conn.RenameFile(torrent.Hash, fileId, oldPath, newPath, req.Name)
+	case isFolder:
+		logger.Info("Renaming folder")
+		err = conn.RenameFolder(torrent.Hash, oldPath, newPath)
+	default:
+		return nil, InvalidArgument("Path not found: %s", req.Path)
+	}
+	if isConflict(err) {
+		// Like Transmission, which reports EEXIST
+		return nil, InvalidArgument("File exists: %s", newPath)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Like in Transmission, renaming the top-level file or folder renames the torrent itself
+	if oldPath == torrent.Name {
+		if err := conn.RenameTorrent(torrent.Hash, req.Name); err != nil {
+			return nil, err
 		}
 	}
 
-	return JsonMap{}, "success" // TODO
+	return JsonMap{
+		"path": req.Path,
+		"name": req.Name,
+		"id":   torrent.Id,
+	}, nil
+}
+
+// invalidateRenamedTorrent drops cached data of a torrent, so that the next torrent-get shows the new names
+func invalidateRenamedTorrent(hash qBT.Hash) {
+	propsCache.Invalidate(hash)
+	trackersCache.Invalidate(hash)
 }
 
 var additionalArgumentsRegexp = regexp.MustCompile("([+\\-])([sfh]+)$")
@@ -1040,21 +2012,25 @@ func parseAdditionalLocationArguments(originalLocation string) (args additionalA
 	return
 }
 
-func TorrentSetLocation(args json.RawMessage) (JsonMap, string) {
+func TorrentSetLocation(conn *qBT.Connection, args json.RawMessage) (JsonMap, error) {
 	var req struct {
 		Ids      *json.RawMessage
 		Location *string     `json:"location"`
 		Move     interface{} `json:"move"`
 	}
-	err := json.Unmarshal(args, &req)
-	Check(err)
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, ArgumentError(err)
+	}
 
-	log.Debug("New location: ", *req.Location)
 	if req.Location == nil {
-		return JsonMap{}, "Absent location field"
+		return nil, InvalidArgument("Absent location field")
 	}
+	log.Debug("New location: ", *req.Location)
 
-	torrents := parseIDsField(req.Ids)
+	torrents, err := parseIDsField(conn, req.Ids)
+	if err != nil {
+		return nil, err
+	}
 
 	/*var move bool // TODO: Move to a function
 	switch val := req.Move.(type) {
@@ -1065,17 +2041,23 @@ func TorrentSetLocation(args json.RawMessage) (JsonMap, string) {
 	}*/
 
 	extraArgs, strippedLocation, err := parseAdditionalLocationArguments(*req.Location)
-	Check(err)
+	if err != nil {
+		return nil, InvalidArgument("Invalid location: %v", err)
+	}
 
 	if extraArgs.firstLastPiecesFirst != ARGUMENT_NOT_SET {
 		for _, torrent := range torrents {
-			qBTConn.SetFirstLastPieceFirst(torrent.Hash, extraArgs.firstLastPiecesFirst == ARGUMENT_TRUE)
+			if err := conn.SetFirstLastPieceFirst(torrent.Hash, extraArgs.firstLastPiecesFirst == ARGUMENT_TRUE); err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	if extraArgs.sequentialDownload != ARGUMENT_NOT_SET {
 		for _, torrent := range torrents {
-			qBTConn.SetSequentialDownload(torrent.Hash, extraArgs.sequentialDownload == ARGUMENT_TRUE)
+			if err := conn.SetSequentialDownload(torrent.Hash, extraArgs.sequentialDownload == ARGUMENT_TRUE); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -1083,86 +2065,193 @@ func TorrentSetLocation(args json.RawMessage) (JsonMap, string) {
 		"hashes":   {torrents.ConcatenateHashes()},
 		"location": {strippedLocation},
 	}
-	qBTConn.PostForm(qBTConn.MakeRequestURL("torrents/setLocation"), params)
+	if _, err := conn.PostForm(conn.MakeRequestURL("torrents/setLocation"), params); err != nil {
+		return nil, err
+	}
+
+	return JsonMap{}, nil
+}
+
+const SESSION_ID_HEADER = "X-Transmission-Session-Id"
+
+// Generated on each start, so clients have to repeat the handshake after a restart
+var sessionID = newSessionID()
+
+func newSessionID() string {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	Check(err)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// checkSessionID emulates Transmission's CSRF protection: a request without a valid session id
+// gets HTTP 409 with the id that should be sent back
+func checkSessionID(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set(SESSION_ID_HEADER, sessionID)
+	w.Header().Set("Access-Control-Expose-Headers", SESSION_ID_HEADER)
+	if settings().noSessionID || r.Header.Get(SESSION_ID_HEADER) == sessionID {
+		return true
+	}
+	log.Debug("Invalid session id, replying with 409")
+	w.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+	w.WriteHeader(http.StatusConflict)
+	fmt.Fprintf(w, "<h1>409: Conflict</h1><p>Your request had an invalid session-id header.</p>"+
+		"<p><code>%s: %s</code></p>", SESSION_ID_HEADER, sessionID)
+	return false
+}
 
-	return JsonMap{}, "success"
+// authenticate checks credentials of a request. Rejected requests get HTTP 401 and a nil connection.
+func authenticate(w http.ResponseWriter, r *http.Request) (*qBT.Connection, error) {
+	username, password, _ := r.BasicAuth()
+	conn, err := settings().authenticator.Authenticate(clientIP(r), username, password)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Transmission"`)
+		w.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "<h1>401: Unauthorized</h1>Unauthorized User")
+	}
+	return conn, nil
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
 	var req transmission.RPCRequest
+	writeError := func(err error) {
+		rpcErr := toRPCError(err)
+		log.WithField("method", req.Method).WithField("status", rpcErr.HTTPStatus).Error(rpcErr.Result)
+		writeResponse(w, rpcErr.HTTPStatus, JsonMap{}, rpcErr.Result, req.Tag)
+	}
+	// Errors are returned, so a panic is a bug, but it shouldn't drop the connection
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			writeError(fmt.Errorf("%v", recovered))
+		}
+	}()
+
+	// Like Transmission, check credentials before the session id
+	conn, err := authenticate(w, r)
+	if err != nil {
+		writeError(err)
+		return
+	}
+	if conn == nil {
+		return
+	}
+	if !checkSessionID(w, r) {
+		return
+	}
+
 	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(BadRequest("Can't read request: %v", err))
+		return
+	}
 	log.Debug("Got request ", string(reqBody))
 	err = json.Unmarshal(reqBody, &req)
-	Check(err)
-
-	if !qBTConn.IsLoggedIn() {
-		var authOK = false
-		username, password, present := r.BasicAuth()
-		if present {
-			authOK = qBTConn.Login(username, password)
-		} else {
-			authOK = qBTConn.Login("", "")
-		}
-		if !authOK {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	if err != nil {
+		writeError(BadRequest("JSON parse error: %v", err))
+		return
+	}
+	if len(req.Arguments) == 0 {
+		req.Arguments = json.RawMessage("{}")
 	}
 
 	var resp JsonMap
-	var result string
 	switch req.Method {
 	case "session-get":
-		resp, result = SessionGet()
+		resp, err = SessionGet(conn)
 	case "free-space":
-		resp, result = FreeSpace(req.Arguments)
+		resp, err = FreeSpace(req.Arguments)
 	case "torrent-get":
-		resp, result = TorrentGet(req.Arguments)
+		resp, err = TorrentGet(conn, req.Arguments)
+	case "session-set":
+		resp, err = SessionSet(conn, req.Arguments)
 	case "session-stats":
-		resp, result = SessionStats()
+		resp, err = SessionStats(conn)
 	case "torrent-stop":
-		resp, result = TorrentPause(req.Arguments)
+		resp, err = TorrentPause(conn, req.Arguments)
 	case "torrent-start":
-		resp, result = TorrentResume(req.Arguments)
+		resp, err = TorrentResume(conn, req.Arguments)
 	case "torrent-start-now":
-		resp, result = TorrentResume(req.Arguments)
+		resp, err = TorrentStartNow(conn, req.Arguments)
 	case "torrent-verify":
-		resp, result = TorrentRecheck(req.Arguments)
+		resp, err = TorrentRecheck(conn, req.Arguments)
+	case "torrent-reannounce":
+		resp, err = TorrentReannounce(conn, req.Arguments)
 	case "torrent-remove":
-		resp, result = TorrentDelete(req.Arguments)
+		resp, err = TorrentDelete(conn, req.Arguments)
 	case "torrent-add":
-		resp, result = TorrentAdd(req.Arguments)
+		resp, err = TorrentAdd(conn, req.Arguments)
 	case "torrent-set":
-		resp, result = TorrentSet(req.Arguments)
+		resp, err = TorrentSet(conn, req.Arguments)
 	case "torrent-set-location":
-		resp, result = TorrentSetLocation(req.Arguments)
+		resp, err = TorrentSetLocation(conn, req.Arguments)
+	case "torrent-rename-path":
+		resp, err = TorrentRenamePath(conn, req.Arguments)
+	case "queue-move-top":
+		resp, err = QueueMove(conn, req.Arguments, "torrents/topPrio")
+	case "queue-move-up":
+		resp, err = QueueMove(conn, req.Arguments, "torrents/increasePrio")
+	case "queue-move-down":
+		resp, err = QueueMove(conn, req.Arguments, "torrents/decreasePrio")
+	case "queue-move-bottom":
+		resp, err = QueueMove(conn, req.Arguments, "torrents/bottomPrio")
 	default:
-		log.Error("Unknown method: ", req.Method)
+		err = InvalidArgument("method name not recognized")
 	}
+	if err != nil {
+		writeError(err)
+		return
+	}
+	writeResponse(w, http.StatusOK, resp, "success", req.Tag)
+}
+
+func writeResponse(w http.ResponseWriter, status int, arguments JsonMap, result string, tag *int) {
 	response := JsonMap{
 		"result":    result,
-		"arguments": resp,
+		"arguments": arguments,
 	}
-	if req.Tag != nil {
-		response["tag"] = req.Tag
+	if tag != nil {
+		response["tag"] = tag
 	}
 	respBody, err := json.Marshal(response)
-	Check(err)
+	if err != nil {
+		log.WithError(err).Error("Can't encode response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	log.Debug("respBody: ", string(respBody))
 	w.Header().Set("Content-Length", strconv.Itoa(len(respBody)))
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
 	_, err = w.Write(respBody) // TODO: Check whether it's necessary to evaluate written bytes number
-	Check(err)
+	if err != nil {
+		log.Warn("Can't write response: ", err)
+	}
 }
 
 func main() {
-	switch {
-	case *debug:
-		log.SetLevel(log.DebugLevel)
-	case *verbose:
-		log.SetLevel(log.InfoLevel)
-	default:
-		log.SetLevel(log.WarnLevel)
+	err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if *hashPassword != "" {
+		hash, err := HashPassword(*hashPassword)
+		if err != nil {
+			log.Fatal("Can't hash password: ", err)
+		}
+		fmt.Println(hash)
+		return
+	}
+	err = applyRuntimeSettings()
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if _, supported := transmission.Releases[int(*rpcVersion)]; !supported {
+		log.Fatalf("Invalid configuration: rpc-version must be between %d and %d",
+			transmission.RPCVersionLegacy, transmission.RPCVersionLatest)
 	}
 	var cl *http.Client
 	if *disableKeepAlive {
@@ -1175,10 +2264,25 @@ func main() {
 		cl = &http.Client{}
 	}
 	qBTConn.Init(*apiAddr, cl, *useSync)
+	go reloadConfigOnSIGHUP()
+
+	addresses, err := parseListenAddresses(*listenAddrs, *port)
+	if err != nil {
+		log.Fatal("Invalid -listen value: ", err)
+	}
+	socketMode, err := parseSocketMode(*unixSocketMode)
+	if err != nil {
+		log.Fatal("Invalid -unix-socket-mode value: ", err)
+	}
+	tlsConfig, err := makeTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		log.Fatal("Can't set up TLS: ", err)
+	}
 
 	http.HandleFunc("/transmission/rpc", handler)
 	http.HandleFunc("/rpc", handler)
+	http.HandleFunc("/debug/fields", fieldsHandler)
 	http.Handle("/", http.FileServer(http.Dir("web/")))
-	err := http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)
+	err = serve(http.DefaultServeMux, addresses, tlsConfig, socketMode)
 	Check(err)
 }
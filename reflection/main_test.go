@@ -1,13 +1,24 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"github.com/h31/Reflection/qBT"
+	"github.com/h31/Reflection/transmission"
 	"github.com/hekmon/transmissionrpc"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/h2non/gock.v1"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
@@ -48,6 +59,100 @@ func TestAdditionalLocationArguments(t *testing.T) {
 	}
 }
 
+func TestFilePriorities(t *testing.T) {
+	tables := []struct {
+		qBTPriority int
+		trPriority  int
+	}{
+		{1, TR_PRI_LOW},
+		{2, TR_PRI_NORMAL},
+		{4, TR_PRI_NORMAL},
+		{6, TR_PRI_NORMAL},
+		{7, TR_PRI_HIGH},
+	}
+
+	for _, table := range tables {
+		if priority := qBTFilePriorityToTR(table.qBTPriority); priority != table.trPriority {
+			t.Errorf("qBittorrent priority %d, expected %d, got %d", table.qBTPriority, table.trPriority, priority)
+		}
+	}
+
+	trTables := []struct {
+		trPriority  int
+		qBTPriority int
+	}{
+		{TR_PRI_LOW, 1},
+		{TR_PRI_NORMAL, 6},
+		{TR_PRI_HIGH, 7},
+	}
+
+	for _, table := range trTables {
+		if priority := trFilePriorityToQBT(table.trPriority); priority != table.qBTPriority {
+			t.Errorf("Transmission priority %d, expected %d, got %d", table.trPriority, table.qBTPriority, priority)
+		}
+		if priority := qBTFilePriorityToTR(trFilePriorityToQBT(table.trPriority)); priority != table.trPriority {
+			t.Errorf("Transmission priority %d didn't survive a round trip, got %d", table.trPriority, priority)
+		}
+	}
+}
+
+func TestShareLimits(t *testing.T) {
+	global := TR_RATIOLIMIT_GLOBAL
+	single := TR_RATIOLIMIT_SINGLE
+	unlimited := TR_RATIOLIMIT_UNLIMITED
+	limit := 1.5
+
+	tables := []struct {
+		current   float64
+		effective float64
+		mode      *int
+		limit     *float64
+		expected  float64
+	}{
+		{QBT_SHARE_LIMIT_GLOBAL, 2, nil, nil, QBT_SHARE_LIMIT_GLOBAL},
+		{QBT_SHARE_LIMIT_GLOBAL, 2, nil, &limit, QBT_SHARE_LIMIT_GLOBAL},
+		{3, 3, nil, &limit, 1.5},
+		{3, 3, &global, &limit, QBT_SHARE_LIMIT_GLOBAL},
+		{3, 3, &unlimited, nil, QBT_SHARE_LIMIT_UNLIMITED},
+		{QBT_SHARE_LIMIT_GLOBAL, 2, &single, nil, 2},
+		{QBT_SHARE_LIMIT_UNLIMITED, -1, &single, &limit, 1.5},
+	}
+
+	for _, table := range tables {
+		result := trShareLimitToQBT(table.current, table.effective, table.mode, table.limit)
+		if result != table.expected {
+			t.Errorf("Input %+v, expected %v, got %v", table, table.expected, result)
+		}
+	}
+}
+
+func TestSchedulerDays(t *testing.T) {
+	tables := []struct {
+		qBTDays int
+		trDays  int
+	}{
+		{0, 127},
+		{1, 62},
+		{2, 65},
+		{3, 2},  // Monday
+		{8, 64}, // Saturday
+		{9, 1},  // Sunday
+	}
+
+	for _, table := range tables {
+		if days := qBTSchedulerDaysToTR(table.qBTDays); days != table.trDays {
+			t.Errorf("qBittorrent days %d, expected %d, got %d", table.qBTDays, table.trDays, days)
+		}
+		if days, err := trSchedulerDaysToQBT(table.trDays); days != table.qBTDays || err != nil {
+			t.Errorf("Transmission days %d, expected %d, got (%d, %v)", table.trDays, table.qBTDays, days, err)
+		}
+	}
+
+	if _, err := trSchedulerDaysToQBT(2 | 4); err == nil {
+		t.Error("Unsupported combination of days was accepted")
+	}
+}
+
 func TestTorrentListing(t *testing.T) {
 	const apiAddr = "http://localhost:8080"
 	log.SetLevel(currentLogLevel)
@@ -408,6 +513,123 @@ func TestTorrentAdd(t *testing.T) {
 	}
 }
 
+// mockAddedTorrent makes the torrent appear in qBittorrent on the second torrents/info request
+func mockAddedTorrent(hash qBT.Hash, name string) {
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/info").
+		Reply(200).
+		File("testdata/torrent_list.json")
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/info").
+		Reply(200).
+		JSON([]JsonMap{{"hash": hash, "name": name}})
+}
+
+// mockFileSelections expects files of a two-file torrent to become high priority and unwanted, then the torrent to be resumed
+func mockFileSelections(hash qBT.Hash) *gock.Request {
+	gock.New(testAPIAddr).
+		Post("/api/v2/torrents/filePrio").
+		BodyString("hash=" + string(hash) + "&id=0&priority=7").
+		Reply(200)
+	gock.New(testAPIAddr).
+		Post("/api/v2/torrents/filePrio").
+		BodyString("hash=" + string(hash) + "&id=1&priority=0").
+		Reply(200)
+	resume := gock.New(testAPIAddr).
+		Post("/api/v2/torrents/resume").
+		BodyString("hashes=" + string(hash))
+	resume.Reply(200)
+	return resume
+}
+
+var twoFiles = []JsonMap{{"name": "test/a.txt", "priority": 6}, {"name": "test/b.txt", "priority": 6}}
+
+func TestTorrentAddFileSelections(t *testing.T) {
+	server, stop := startTestServer(t, false)
+	defer stop()
+	gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=1")
+
+	info := "d5:filesld6:lengthi1e4:pathl5:a.txteed6:lengthi1e4:pathl5:b.txteee" +
+		"4:name4:test12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "e"
+	metainfo := "d4:info" + info + "e"
+	hash := qBT.Hash(fmt.Sprintf("%x", sha1.Sum([]byte(info))))
+
+	mockAddedTorrent(hash, "test")
+	// Added paused, so that nothing is downloaded before file selections are applied
+	gock.New(testAPIAddr).
+		Post("/api/v2/torrents/add").
+		BodyString(`name="paused"\r\n\r\ntrue`).
+		Reply(200)
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/files").
+		MatchParam("hash", string(hash)).
+		Reply(200).
+		JSON(twoFiles)
+	mockFileSelections(hash)
+
+	added := rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-add", "arguments": {"metainfo": %q,
+		"priority-high": [0], "files-unwanted": [1]}}`, base64.StdEncoding.EncodeToString([]byte(metainfo))))
+	if torrent, ok := added["torrent-added"].(map[string]interface{}); !ok || torrent["hashString"] != string(hash) {
+		t.Errorf("Unexpected response: %v", added)
+	}
+	if !gock.IsDone() {
+		t.Error("Not all requests were made")
+	}
+}
+
+func TestMagnetAddFileSelections(t *testing.T) {
+	server, stop := startTestServer(t, false)
+	defer stop()
+	defer func(interval time.Duration) { METADATA_WAIT_INTERVAL = interval }(METADATA_WAIT_INTERVAL)
+	METADATA_WAIT_INTERVAL = 10 * time.Millisecond
+	gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=1")
+
+	const hash = qBT.Hash("0123456789abcdef0123456789abcdef01234567")
+	mockAddedTorrent(hash, "test")
+	gock.New(testAPIAddr).
+		Get("/api/v2/app/version").
+		Reply(200).
+		BodyString("v4.5.2")
+	// A magnet has to be started to get metadata, qBittorrent stops it right after that
+	gock.New(testAPIAddr).
+		Post("/api/v2/torrents/add").
+		BodyString(`name="stopCondition"\r\n\r\nMetadataReceived[\s\S]*name="paused"\r\n\r\nfalse`).
+		Reply(200)
+	// qBittorrent may not know about the torrent yet, then the metadata is being fetched
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/files").
+		Reply(404)
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/files").
+		Reply(200).
+		JSON([]JsonMap{})
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/files").
+		Times(2).
+		Reply(200).
+		JSON(twoFiles)
+	resume := mockFileSelections(hash)
+
+	added := rpcRequest(server.URL, `{"method": "torrent-add", "arguments": {"filename": "magnet:?xt=urn:btih:`+
+		string(hash)+`&dn=test", "priority-high": [0], "files-unwanted": [1]}}`)
+	if torrent, ok := added["torrent-added"].(map[string]interface{}); !ok || torrent["hashString"] != string(hash) {
+		t.Errorf("Unexpected response: %v", added)
+	}
+
+	for retries := 0; retries < 100 && !resume.Mock.Done(); retries++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !gock.IsDone() {
+		t.Error("File selections weren't applied after receiving metadata")
+	}
+}
+
 func TestTorrentMove(t *testing.T) {
 	const apiAddr = "http://localhost:8080"
 	log.SetLevel(currentLogLevel)
@@ -470,6 +692,1438 @@ func TestTorrentMove(t *testing.T) {
 	}
 }
 
+func TestTorrentSetSpeedLimits(t *testing.T) {
+	const hashes = "hashes=842783e3005495d5d1637f5364b59343c7844707"
+	limit := int64(500)
+	limited, unlimited := true, false
+	runTorrentSetTests(t, []torrentSetTest{
+		{"upload limit",
+			transmissionrpc.TorrentSetPayload{UploadLimit: &limit, UploadLimited: &limited, DownloadLimited: &unlimited},
+			[]expectedRequest{{"setUploadLimit", hashes + "&limit=500000"}, {"setDownloadLimit", hashes + "&limit=0"}}},
+		{"download limit without a flag",
+			transmissionrpc.TorrentSetPayload{DownloadLimit: &limit},
+			[]expectedRequest{{"setDownloadLimit", hashes + "&limit=500000"}}},
+		{"disabled limit ignores the value",
+			transmissionrpc.TorrentSetPayload{UploadLimit: &limit, UploadLimited: &unlimited},
+			[]expectedRequest{{"setUploadLimit", hashes + "&limit=0"}}},
+		{"session limits can't be ignored",
+			transmissionrpc.TorrentSetPayload{HonorsSessionLimits: &unlimited},
+			nil},
+	})
+}
+
+func TestIdleSeedingLimits(t *testing.T) {
+	server, stop := startTestServer(t, false)
+	defer stop()
+	gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=1")
+	// The first torrent comes from qBittorrent 4.6+, which has a separate inactive seeding time limit
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/info").
+		Persist().
+		Reply(200).
+		BodyString(`[{"hash": "aaaa", "seeding_time_limit": 600, "max_seeding_time": 600,
+				"inactive_seeding_time_limit": -2, "max_inactive_seeding_time": 30},
+			{"hash": "bbbb", "seeding_time_limit": 600, "max_seeding_time": 600}]`)
+
+	torrents := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"fields": ["id", "hashString", "seedIdleMode", "seedIdleLimit"]}}`)["torrents"].([]interface{})
+	ids := make(map[string]interface{})
+	for _, item := range torrents {
+		torrent := item.(map[string]interface{})
+		ids[torrent["hashString"].(string)] = torrent["id"]
+		expected := map[string][]float64{"aaaa": {TR_RATIOLIMIT_GLOBAL, 30}, "bbbb": {TR_RATIOLIMIT_SINGLE, 600}}[torrent["hashString"].(string)]
+		if torrent["seedIdleMode"] != expected[0] || torrent["seedIdleLimit"] != expected[1] {
+			t.Errorf("Unexpected idle limits: %v", torrent)
+		}
+	}
+
+	newLimits := []*gock.Request{
+		gock.New(testAPIAddr).
+			Post("/api/v2/torrents/setShareLimits").
+			BodyString("^hashes=aaaa&inactiveSeedingTimeLimit=60&ratioLimit=0&seedingTimeLimit=600$"),
+		gock.New(testAPIAddr).
+			Post("/api/v2/torrents/setShareLimits").
+			BodyString("^hashes=bbbb&inactiveSeedingTimeLimit=-2&ratioLimit=0&seedingTimeLimit=60$"),
+	}
+	for _, mock := range newLimits {
+		mock.Reply(200)
+	}
+	rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-set", "arguments": {"ids": [%v, %v], "seedIdleMode": 1, "seedIdleLimit": 60}}`,
+		ids["aaaa"], ids["bbbb"]))
+
+	for _, mock := range newLimits {
+		if !mock.Mock.Done() {
+			t.Error("Idle seeding limit wasn't set")
+		}
+	}
+}
+
+func TestTorrentSetTrackers(t *testing.T) {
+	const hash = "hash=842783e3005495d5d1637f5364b59343c7844707"
+	runTorrentSetTests(t, []torrentSetTest{
+		{"add and remove",
+			transmissionrpc.TorrentSetPayload{
+				TrackerAdd:    []string{"http://tracker.example.com/announce"},
+				TrackerRemove: []int64{int64(trackerID("http://ipv6.torrent.ubuntu.com:6969/announce"))},
+			},
+			[]expectedRequest{
+				{"removeTrackers", hash + "&urls=http%3A%2F%2Fipv6.torrent.ubuntu.com%3A6969%2Fannounce"},
+				{"addTrackers", hash + "&urls=http%3A%2F%2Ftracker.example.com%2Fannounce"},
+			}},
+		{"unknown ID",
+			transmissionrpc.TorrentSetPayload{TrackerRemove: []int64{1}},
+			nil},
+	})
+}
+
+func TestTorrentRename(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	const singleFile = "842783e3005495d5d1637f5364b59343c7844707"
+	const withFolder = "cf7da7ab4d4e6125567bd979994f13bb1f23dddd"
+	ids := make(map[string]interface{})
+	torrents := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"fields": ["id", "hashString"]}}`)["torrents"].([]interface{})
+	for _, item := range torrents {
+		torrent := item.(map[string]interface{})
+		ids[torrent["hashString"].(string)] = torrent["id"]
+	}
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/files").
+		MatchParam("hash", singleFile).
+		Persist().
+		Reply(200).
+		File("testdata/torrent_2_files.json")
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/files").
+		MatchParam("hash", withFolder).
+		Persist().
+		Reply(200).
+		JSON([]JsonMap{{"name": "ubuntu-18.04.2-desktop-amd64.iso/dir/a.txt"}, {"name": "ubuntu-18.04.2-desktop-amd64.iso/b.txt"}})
+
+	// Renaming the top-level file renames the torrent too
+	propsCache.GetOrFill(singleFile, JsonMap{}, true, func(dest JsonMap) error { return nil })
+	renamed := []*gock.Request{
+		gock.New(testAPIAddr).
+			Post("/api/v2/torrents/renameFile").
+			BodyString("^hash=" + singleFile + "&id=0&name=server.iso&newPath=server.iso&oldPath=ubuntu-18.04.2-live-server-amd64.iso$"),
+		gock.New(testAPIAddr).
+			Post("/api/v2/torrents/rename").
+			BodyString("^hash=" + singleFile + "&name=server.iso$"),
+		gock.New(testAPIAddr).
+			Post("/api/v2/torrents/renameFolder").
+			BodyString("^hash=" + withFolder + "&newPath=ubuntu-18.04.2-desktop-amd64.iso%2Fdata&oldPath=ubuntu-18.04.2-desktop-amd64.iso%2Fdir$"),
+		gock.New(testAPIAddr).
+			Post("/api/v2/torrents/rename").
+			BodyString("^hash=" + withFolder + "&name=desktop$"),
+	}
+	for _, mock := range renamed {
+		mock.Reply(200)
+	}
+	result := rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-rename-path", "arguments": {"ids": [%v],
+		"path": "ubuntu-18.04.2-live-server-amd64.iso", "name": "server.iso"}}`, ids[singleFile]))
+	if result["name"] != "server.iso" || result["id"] != ids[singleFile] {
+		t.Errorf("Unexpected response: %v", result)
+	}
+	if _, cached := propsCache.Values[singleFile]; cached {
+		t.Error("Properties of the renamed torrent are still cached")
+	}
+	rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-rename-path", "arguments": {"ids": [%v],
+		"path": "ubuntu-18.04.2-desktop-amd64.iso/dir", "name": "data"}}`, ids[withFolder]))
+	rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-set", "arguments": {"ids": [%v], "name": "desktop"}}`, ids[withFolder]))
+	for _, mock := range renamed {
+		if !mock.Mock.Done() {
+			t.Errorf("Request wasn't made: %s", mock.URLStruct.Path)
+		}
+	}
+
+	// qBittorrent refuses to overwrite an existing file with HTTP 409
+	gock.New(testAPIAddr).
+		Post("/api/v2/torrents/renameFile").
+		Reply(409).
+		BodyString("Target file exists")
+	tables := []struct {
+		request string
+		result  string
+	}{
+		{fmt.Sprintf(`{"method": "torrent-rename-path", "arguments": {"ids": [%v], "path": "ubuntu-18.04.2-desktop-amd64.iso/b.txt", "name": "c.txt"}}`, ids[withFolder]),
+			"File exists: ubuntu-18.04.2-desktop-amd64.iso/c.txt"},
+		{fmt.Sprintf(`{"method": "torrent-rename-path", "arguments": {"ids": [%v], "path": "no-such-file", "name": "c.txt"}}`, ids[withFolder]),
+			"Path not found: no-such-file"},
+		// Nothing is changed if one of the arguments is invalid
+		{fmt.Sprintf(`{"method": "torrent-set", "arguments": {"ids": [%v, %v], "uploadLimit": 10, "uploadLimited": true, "name": "both"}}`,
+			ids[withFolder], ids[singleFile]), "Only a single torrent can be renamed"},
+	}
+	for _, table := range tables {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(table.request))
+		Check(err)
+		req.Header.Set(SESSION_ID_HEADER, sessionID)
+		resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+		Check(err)
+		var body struct{ Result string }
+		Check(json.NewDecoder(resp.Body).Decode(&body))
+		resp.Body.Close()
+		if body.Result != table.result {
+			t.Errorf("Request %s, expected %q, got %q", table.request, table.result, body.Result)
+		}
+	}
+	if gock.HasUnmatchedRequest() {
+		t.Errorf("Unexpected requests: %v", gock.GetUnmatchedRequests()[0].URL)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	server, stop := startTestServer(t, false)
+	defer stop()
+	gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=1")
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/info").
+		Persist().
+		Reply(200).
+		BodyString(`[{"hash": "aaaa", "priority": 2}, {"hash": "bbbb", "priority": 0},
+			{"hash": "cccc", "priority": 1}, {"hash": "dddd", "priority": 0}]`)
+
+	torrents := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"fields": ["id", "hashString", "queuePosition"]}}`)["torrents"].([]interface{})
+	ids := make(map[string]float64)
+	positions := make(map[string]float64)
+	for _, item := range torrents {
+		torrent := item.(map[string]interface{})
+		ids[torrent["hashString"].(string)] = torrent["id"].(float64)
+		positions[torrent["hashString"].(string)] = torrent["queuePosition"].(float64)
+	}
+	if positions["aaaa"] != 1 || positions["cccc"] != 0 {
+		t.Errorf("Unexpected positions of queued torrents: %v", positions)
+	}
+	// Torrents which aren't queued go after queued ones
+	first, second := "bbbb", "dddd"
+	if ids[first] > ids[second] {
+		first, second = second, first
+	}
+	if positions[first] != 2 || positions[second] != 3 {
+		t.Errorf("Unexpected positions of torrents which aren't queued: %v", positions)
+	}
+	table := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"format": "table", "fields": ["hashString", "queuePosition"]}}`)["torrents"].([]interface{})
+	for _, item := range table[1:] {
+		row := item.([]interface{})
+		if row[1] != positions[row[0].(string)] {
+			t.Errorf("Unexpected position in the table format: %v", row)
+		}
+	}
+
+	tables := []struct {
+		method string
+		path   string
+	}{
+		{"queue-move-top", "topPrio"},
+		{"queue-move-up", "increasePrio"},
+		{"queue-move-down", "decreasePrio"},
+		{"queue-move-bottom", "bottomPrio"},
+	}
+	for _, table := range tables {
+		mock := gock.New(testAPIAddr).
+			Post("/api/v2/torrents/" + table.path).
+			BodyString("^hashes=aaaa$")
+		mock.Reply(200)
+		rpcRequest(server.URL, fmt.Sprintf(`{"method": %q, "arguments": {"ids": [%v]}}`, table.method, ids["aaaa"]))
+		if !mock.Mock.Done() {
+			t.Errorf("%s wasn't sent to %s", table.method, table.path)
+		}
+	}
+}
+
+func TestTorrentReannounce(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	const hash = "842783e3005495d5d1637f5364b59343c7844707"
+	getAnnounceTime := func() (id, announceTime float64) {
+		torrents := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"fields": ["id", "hashString", "manualAnnounceTime"]}}`)["torrents"].([]interface{})
+		for _, item := range torrents {
+			torrent := item.(map[string]interface{})
+			if torrent["hashString"] == hash {
+				return torrent["id"].(float64), torrent["manualAnnounceTime"].(float64)
+			}
+		}
+		t.Fatal("Torrent not found")
+		return
+	}
+	id, announceTime := getAnnounceTime()
+	if announceTime != 0 {
+		t.Errorf("Unexpected manualAnnounceTime before reannouncing: %v", announceTime)
+	}
+
+	reannounceMock := gock.New(testAPIAddr).
+		Post("/api/v2/torrents/reannounce").
+		BodyString("^hashes=" + hash + "$")
+	reannounceMock.Reply(200)
+	rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-reannounce", "arguments": {"ids": [%v]}}`, id))
+	if !reannounceMock.Mock.Done() {
+		t.Error("Torrent wasn't reannounced")
+	}
+
+	// Like Transmission, the next manual announce is allowed in a minute
+	_, announceTime = getAnnounceTime()
+	if now := time.Now().Unix(); int64(announceTime) <= now || int64(announceTime) > now+int64(MANUAL_ANNOUNCE_INTERVAL/time.Second) {
+		t.Errorf("Unexpected manualAnnounceTime after reannouncing: %v", announceTime)
+	}
+}
+
+func TestManualAnnounceTimesExpiry(t *testing.T) {
+	var announces ManualAnnounceTimes
+	announces.Announced(qBT.TorrentInfoList{{Hash: "aaaa"}, {Hash: "bbbb"}})
+	expired := time.Now().Unix() - 1
+	announces.times["aaaa"], announces.times["bbbb"] = expired, expired
+
+	if announceTime := announces.Get("aaaa"); announceTime != 0 {
+		t.Errorf("Expected no manualAnnounceTime after it expired, got %v", announceTime)
+	}
+	announces.Announced(qBT.TorrentInfoList{{Hash: "cccc"}})
+	if _, kept := announces.times["bbbb"]; kept || len(announces.times) != 1 {
+		t.Errorf("Expired times weren't dropped: %v", announces.times)
+	}
+}
+
+func TestTorrentStartNow(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	torrents := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"fields": ["id"]}}`)["torrents"].([]interface{})
+	ids := []interface{}{torrents[0].(map[string]interface{})["id"], torrents[1].(map[string]interface{})["id"]}
+
+	forceStartMock := gock.New(testAPIAddr).
+		Post("/api/v2/torrents/setForceStart").
+		BodyString("^hashes=(cf7da7ab4d4e6125567bd979994f13bb1f23dddd%7C842783e3005495d5d1637f5364b59343c7844707|" +
+			"842783e3005495d5d1637f5364b59343c7844707%7Ccf7da7ab4d4e6125567bd979994f13bb1f23dddd)&value=true$")
+	forceStartMock.Reply(200)
+	rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-start-now", "arguments": {"ids": [%v, %v]}}`, ids[0], ids[1]))
+	if !forceStartMock.Mock.Done() {
+		t.Error("Torrents weren't force started")
+	}
+}
+
+func TestSessionSet(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	gock.Observe(gock.DumpRequest)
+
+	transmissionbt := newRPCClient(t, server)
+
+	prefsMock := gock.New(testAPIAddr).
+		Post("/api/v2/app/setPreferences").
+		MatchType("url").
+		BodyString("^json=%7B%22dl_limit%22%3A100000%2C%22encryption%22%3A1%7D$").
+		Reply(200)
+
+	speedLimitDown := int64(100)
+	speedLimitDownEnabled := true
+	encryption := "required"
+	err := transmissionbt.SessionArgumentsSet(&transmissionrpc.SessionArguments{
+		SpeedLimitDown:        &speedLimitDown,
+		SpeedLimitDownEnabled: &speedLimitDownEnabled,
+		Encryption:            &encryption,
+	})
+	Check(err)
+
+	if !prefsMock.Mock.Done() {
+		t.Error("Preferences were not set")
+	}
+
+	gock.New(testAPIAddr).
+		Get("/api/v2/app/preferences").
+		Reply(200).
+		JSON(map[string]interface{}{})
+	gock.New(testAPIAddr).
+		Get("/api/v2/app/version").
+		Reply(200).
+		BodyString("v4.1.6")
+	gock.New(testAPIAddr).
+		Get("/api/v2/transfer/speedLimitsMode").
+		Reply(200).
+		BodyString("0")
+
+	blocklistEnabled := true
+	err = transmissionbt.SessionArgumentsSet(&transmissionrpc.SessionArguments{
+		BlocklistEnabled: &blocklistEnabled,
+	})
+	if err == nil || !strings.Contains(err.Error(), "blocklist-enabled") {
+		t.Error("Unsupported argument was accepted: ", err)
+	}
+
+	// Alternative speed limits are switched on with a toggle, which is sent only if the mode has to be changed
+	gock.New(testAPIAddr).
+		Post("/api/v2/app/setPreferences").
+		MatchType("url").
+		BodyString("^json=%7B%22alt_dl_limit%22%3A200000%2C%22alt_up_limit%22%3A50000%7D$").
+		Reply(200)
+	gock.New(testAPIAddr).
+		Get("/api/v2/transfer/speedLimitsMode").
+		Reply(200).
+		BodyString("0")
+	toggleMock := gock.New(testAPIAddr).
+		Post("/api/v2/transfer/toggleSpeedLimitsMode")
+	toggleMock.Reply(200)
+	rpcRequest(server.URL, `{"method": "session-set", "arguments": {"alt-speed-enabled": true, "alt-speed-down": 200, "alt-speed-up": 50}}`)
+	if !toggleMock.Mock.Done() {
+		t.Error("Alternative speed limits weren't toggled")
+	}
+
+	gock.New(testAPIAddr).
+		Get("/api/v2/transfer/speedLimitsMode").
+		Reply(200).
+		BodyString("1")
+	rpcRequest(server.URL, `{"method": "session-set", "arguments": {"alt-speed-enabled": true}}`)
+	if gock.HasUnmatchedRequest() {
+		t.Error("Alternative speed limits were toggled although they were already enabled")
+	}
+
+	gock.New(testAPIAddr).
+		Get("/api/v2/app/preferences").
+		Reply(200).
+		JSON(map[string]interface{}{"alt_dl_limit": 200000, "alt_up_limit": 50000})
+	gock.New(testAPIAddr).
+		Get("/api/v2/app/version").
+		Reply(200).
+		BodyString("v4.1.6")
+	gock.New(testAPIAddr).
+		Get("/api/v2/transfer/speedLimitsMode").
+		Reply(200).
+		BodyString("1")
+	session := rpcRequest(server.URL, `{"method": "session-get"}`)
+	if session["alt-speed-enabled"] != true || session["alt-speed-down"] != float64(200) || session["alt-speed-up"] != float64(50) {
+		t.Errorf("Unexpected alternative speed limits: enabled %v, down %v, up %v",
+			session["alt-speed-enabled"], session["alt-speed-down"], session["alt-speed-up"])
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	tables := []struct {
+		request string
+		status  int
+		result  string
+	}{
+		{`{"method": "torrent-get", "arguments": {"ids": [100500], "fields": ["id", "name"]}}`, http.StatusOK, "success"},
+		{`{"method": "torrent-get", "arguments": {"ids": {}, "fields": ["id"]}}`, http.StatusOK, `Invalid ids {}: expected an id, a list of ids or "recently-active"`},
+		{`{"method": "unknown-method"}`, http.StatusOK, "method name not recognized"},
+		{`{"method": "session-set", "arguments": {"download-queue-enabled": true, "seed-queue-enabled": false}}`, http.StatusOK,
+			"qBittorrent can't enable download and seed queues separately"},
+		{`{"method": "torrent-get", `, http.StatusBadRequest, "JSON parse error: unexpected end of JSON input"},
+		{`{"method": "session-stats"}`, http.StatusBadGateway, ""},
+	}
+
+	rpcClient := &http.Client{Transport: &http.Transport{}}
+	for _, table := range tables {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(table.request))
+		Check(err)
+		req.Header.Set(SESSION_ID_HEADER, sessionID)
+		resp, err := rpcClient.Do(req)
+		Check(err)
+		var body struct {
+			Result    string
+			Arguments JsonMap
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		Check(err)
+		if resp.StatusCode != table.status {
+			t.Errorf("Request %s, expected status %d, got %d", table.request, table.status, resp.StatusCode)
+		}
+		if table.result != "" && body.Result != table.result {
+			t.Errorf("Request %s, expected result %q, got %q", table.request, table.result, body.Result)
+		}
+	}
+}
+
+func TestSessionIDHandshake(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	rpcClient := &http.Client{Transport: &http.Transport{}}
+	tables := []struct {
+		sessionID string
+		status    int
+	}{
+		{"", http.StatusConflict},
+		{"invalid", http.StatusConflict},
+		{sessionID, http.StatusOK},
+	}
+
+	for _, table := range tables {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(`{"method": "unknown-method"}`))
+		Check(err)
+		if table.sessionID != "" {
+			req.Header.Set(SESSION_ID_HEADER, table.sessionID)
+		}
+		resp, err := rpcClient.Do(req)
+		Check(err)
+		resp.Body.Close()
+		if resp.StatusCode != table.status {
+			t.Errorf("Session id %q, expected status %d, got %d", table.sessionID, table.status, resp.StatusCode)
+		}
+		if resp.Header.Get(SESSION_ID_HEADER) != sessionID {
+			t.Errorf("Session id %q, expected %s header %q, got %q", table.sessionID, SESSION_ID_HEADER, sessionID, resp.Header.Get(SESSION_ID_HEADER))
+		}
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	hashedSecret, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashedEmpty, err := HashPassword("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := []struct {
+		hash     string
+		password string
+		matches  bool
+	}{
+		{"{49674dc08f73aca066468e521b49af350b696678abcdefgh", "secret", true},
+		{"{49674dc08f73aca066468e521b49af350b696678abcdefgh", "Secret", false},
+		{"{49674dc08f73aca066468e521b49af350b696678", "secret", false},
+		{"secret", "secret", false},
+		{hashedSecret, "secret", true},
+		{hashedEmpty, "", true},
+	}
+
+	for _, table := range tables {
+		if matches := passwordMatches(table.hash, table.password); matches != table.matches {
+			t.Errorf("Hash %s, password %q: expected %t, got %t", table.hash, table.password, table.matches, matches)
+		}
+	}
+}
+
+func TestQBTAuthentication(t *testing.T) {
+	server, stop := startTestServer(t, false)
+	defer stop()
+
+	validLogin := gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		BodyString("password=adminadmin&username=admin").
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=1")
+	invalidLogin := gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		BodyString("password=wrong&username=admin").
+		Reply(200).
+		BodyString("Fails.")
+
+	rpcClient := &http.Client{Transport: &http.Transport{}}
+	tables := []struct {
+		password string
+		status   int
+	}{
+		{"adminadmin", http.StatusOK},
+		{"wrong", http.StatusUnauthorized},
+		// Both results are cached, qBittorrent isn't asked again
+		{"adminadmin", http.StatusOK},
+		{"wrong", http.StatusUnauthorized},
+	}
+
+	for _, table := range tables {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(`{"method": "unknown-method"}`))
+		Check(err)
+		req.SetBasicAuth("admin", table.password)
+		req.Header.Set(SESSION_ID_HEADER, sessionID)
+		resp, err := rpcClient.Do(req)
+		Check(err)
+		resp.Body.Close()
+		if resp.StatusCode != table.status {
+			t.Errorf("Password %q, expected status %d, got %d", table.password, table.status, resp.StatusCode)
+		}
+	}
+	if !validLogin.Mock.Done() || !invalidLogin.Mock.Done() {
+		t.Error("qBittorrent login was not requested")
+	}
+
+	// After several failures, credentials of the same client aren't passed to qBittorrent
+	for i := 1; i < AUTH_MAX_FAILURES_PER_IP; i++ {
+		gock.New(testAPIAddr).
+			Post("/api/v2/auth/login").
+			BodyString(fmt.Sprintf("password=wrong%d&username=admin", i)).
+			Reply(200).
+			BodyString("Fails.")
+	}
+	for i := 1; i <= AUTH_MAX_FAILURES_PER_IP; i++ {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(`{"method": "unknown-method"}`))
+		Check(err)
+		req.SetBasicAuth("admin", fmt.Sprintf("wrong%d", i))
+		req.Header.Set(SESSION_ID_HEADER, sessionID)
+		resp, err := rpcClient.Do(req)
+		Check(err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Attempt %d, expected status %d, got %d", i, http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+	if !gock.IsDone() || gock.HasUnmatchedRequest() {
+		t.Error("Unexpected qBittorrent logins after too many failures")
+	}
+}
+
+func TestAuthFailuresCache(t *testing.T) {
+	gock.Flush()
+	defer gock.Off()
+	qBTConn.Init(testAPIAddr, &http.Client{}, false)
+	gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		Persist().
+		Reply(200).
+		BodyString("Fails.")
+
+	auth := NewQBTAuthenticator()
+	for i := 0; i < AUTH_MAX_CACHED_FAILURES+10; i++ {
+		clientIP := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		if conn, err := auth.Authenticate(clientIP, "admin", fmt.Sprint(i)); conn != nil || err != nil {
+			t.Fatalf("Unexpected result: %v, %v", conn, err)
+		}
+	}
+	if len(auth.results) > AUTH_MAX_CACHED_FAILURES || len(auth.failures) > AUTH_MAX_CACHED_FAILURES {
+		t.Errorf("Too many cached failures: %d results, %d client addresses", len(auth.results), len(auth.failures))
+	}
+
+	// Expired results are removed
+	auth.removeExpired(time.Now().Add(AUTH_FAILURE_CACHE_TIMEOUT))
+	if len(auth.results) != 0 || len(auth.failures) != 0 {
+		t.Errorf("Expired results weren't removed: %d results, %d client addresses", len(auth.results), len(auth.failures))
+	}
+}
+
+func TestPerClientSessions(t *testing.T) {
+	server, stop := startTestServer(t, false)
+	defer stop()
+
+	users := []string{"alice", "bob"}
+	var requests []*gock.Response
+	for _, user := range users {
+		gock.New(testAPIAddr).
+			Post("/api/v2/auth/login").
+			BodyString("password="+user+"&username="+user).
+			Reply(200).
+			SetHeader("Set-Cookie", "SID="+user)
+		requests = append(requests, gock.New(testAPIAddr).
+			Get("/api/v2/torrents/info").
+			MatchHeader("Cookie", "SID="+user).
+			Reply(200).
+			File("testdata/torrent_list.json"))
+	}
+
+	rpcClient := &http.Client{Transport: &http.Transport{}}
+	for _, user := range users {
+		req, err := http.NewRequest("POST", server.URL,
+			strings.NewReader(`{"method": "torrent-get", "arguments": {"fields": ["id"]}}`))
+		Check(err)
+		req.SetBasicAuth(user, user)
+		req.Header.Set(SESSION_ID_HEADER, sessionID)
+		resp, err := rpcClient.Do(req)
+		Check(err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("User %s, unexpected status %d", user, resp.StatusCode)
+		}
+	}
+	for i, request := range requests {
+		if !request.Mock.Done() {
+			t.Errorf("No request with %s's session", users[i])
+		}
+	}
+
+	// Idle sessions are forgotten, so a client has to log in again
+	defer func(timeout time.Duration) { qBT.SESSION_IDLE_TIMEOUT = timeout }(qBT.SESSION_IDLE_TIMEOUT)
+	qBT.SESSION_IDLE_TIMEOUT = 0
+	relogin := gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		BodyString("password=alice&username=alice").
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=alice2")
+	newSession := gock.New(testAPIAddr).
+		Get("/api/v2/torrents/info").
+		MatchHeader("Cookie", "SID=alice2").
+		Reply(200).
+		File("testdata/torrent_list.json")
+	time.Sleep(time.Millisecond)
+	req, err := http.NewRequest("POST", server.URL, strings.NewReader(`{"method": "torrent-get", "arguments": {"fields": ["id"]}}`))
+	Check(err)
+	req.SetBasicAuth("alice", "alice")
+	req.Header.Set(SESSION_ID_HEADER, sessionID)
+	resp, err := rpcClient.Do(req)
+	Check(err)
+	resp.Body.Close()
+	if !relogin.Mock.Done() || !newSession.Mock.Done() {
+		t.Error("Idle session was used again")
+	}
+}
+
+func TestReloadQBTCredentials(t *testing.T) {
+	server, stop := startTestServer(t, false)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "reflection")
+	Check(err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "users.txt")
+	hash, err := HashPassword("secret")
+	Check(err)
+	Check(ioutil.WriteFile(filename, []byte("alice:"+hash+"\n"), 0600))
+	defer func() {
+		for _, name := range []string{"users-file", "qbt-username", "qbt-password"} {
+			f := flag.Lookup(name)
+			Check(f.Value.Set(f.DefValue))
+		}
+	}()
+
+	rpcClient := &http.Client{Transport: &http.Transport{}}
+	torrentGet := func() {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(`{"method": "torrent-get", "arguments": {"fields": ["id"]}}`))
+		Check(err)
+		req.SetBasicAuth("alice", "secret")
+		req.Header.Set(SESSION_ID_HEADER, sessionID)
+		resp, err := rpcClient.Do(req)
+		Check(err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected status %d", resp.StatusCode)
+		}
+	}
+
+	var requests []*gock.Response
+	for _, password := range []string{"old", "new"} {
+		Check(flag.Set("users-file", filename))
+		Check(flag.Set("qbt-username", "admin"))
+		Check(flag.Set("qbt-password", password))
+		Check(applyRuntimeSettings())
+
+		gock.New(testAPIAddr).
+			Post("/api/v2/auth/login").
+			BodyString("password="+password+"&username=admin").
+			Reply(200).
+			SetHeader("Set-Cookie", "SID="+password)
+		request := gock.New(testAPIAddr).
+			Get("/api/v2/torrents/info").
+			MatchHeader("Cookie", "SID="+password).
+			Reply(200).
+			File("testdata/torrent_list.json")
+		requests = append(requests, request)
+		torrentGet()
+	}
+	for i, request := range requests {
+		if !request.Mock.Done() {
+			t.Errorf("Request %d wasn't sent with the current credentials", i)
+		}
+	}
+}
+
+// Every new session gets a full update, which must not make the whole list recently active
+func TestSessionFullUpdate(t *testing.T) {
+	_, stop := startTestServer(t, true)
+	defer stop()
+	defer func(timeout time.Duration) { qBT.RECENTLY_ACTIVE_TIMEOUT = timeout }(qBT.RECENTLY_ACTIVE_TIMEOUT)
+	qBT.RECENTLY_ACTIVE_TIMEOUT = 100 * time.Millisecond
+
+	users := []string{"alice", "bob"}
+	for i, user := range users {
+		gock.New(testAPIAddr).
+			Post("/api/v2/auth/login").
+			BodyString("password="+user+"&username="+user).
+			Reply(200).
+			SetHeader("Set-Cookie", "SID="+user)
+		// Only the second torrent has changed by the time of the second session
+		gock.New(testAPIAddr).
+			Get("/api/v2/sync/maindata").
+			MatchParam("rid", "0").
+			MatchHeader("Cookie", "SID="+user).
+			Reply(200).
+			BodyString(fmt.Sprintf(`{"full_update": true, "rid": 1, "torrents": {
+				"aaaa": {"name": "a", "dlspeed": 0}, "bbbb": {"name": "b", "dlspeed": %d}}}`, i*100))
+	}
+
+	for i, user := range users {
+		if i > 0 {
+			time.Sleep(qBT.RECENTLY_ACTIVE_TIMEOUT)
+		}
+		conn := qBTConn.Session(user)
+		if loggedIn, err := conn.Login(user, user); !loggedIn || err != nil {
+			t.Fatalf("Login failed: %v", err)
+		}
+		if err := conn.UpdateTorrentsList(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	active := qBTConn.TorrentsList.GetActive()
+	if len(active) != 1 || active[0].Hash != "bbbb" || active[0].Dlspeed != 100 {
+		t.Errorf("Unexpected recently active torrents: %+v", active)
+	}
+}
+
+func TestRelogin(t *testing.T) {
+	server, stop := startTestServer(t, false)
+	defer stop()
+
+	gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=1")
+	relogin := gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=2")
+
+	// qBittorrent was restarted, the first session is no longer valid
+	expired := gock.New(testAPIAddr).
+		Get("/api/v2/torrents/info").
+		MatchHeader("Cookie", "SID=1").
+		Reply(403).
+		BodyString("Forbidden")
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/info").
+		MatchHeader("Cookie", "SID=2").
+		Persist().
+		Reply(200).
+		File("testdata/torrent_list.json")
+
+	req, err := http.NewRequest("POST", server.URL,
+		strings.NewReader(`{"method": "torrent-get", "arguments": {"fields": ["id", "name"]}}`))
+	Check(err)
+	req.Header.Set(SESSION_ID_HEADER, sessionID)
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+	Check(err)
+	var body struct {
+		Result    string
+		Arguments struct {
+			Torrents []JsonMap
+		}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	Check(err)
+	if body.Result != "success" || len(body.Arguments.Torrents) != 2 {
+		t.Errorf("Unexpected response: %s, %d torrents", body.Result, len(body.Arguments.Torrents))
+	}
+	if !expired.Mock.Done() || !relogin.Mock.Done() {
+		t.Error("Expired session was not renewed")
+	}
+}
+
+func TestParseListenAddresses(t *testing.T) {
+	tables := []struct {
+		list      string
+		addresses []string
+		valid     bool
+	}{
+		{"", []string{":9091"}, true},
+		{"127.0.0.1:8000", []string{"127.0.0.1:8000"}, true},
+		{"127.0.0.1, [::1]", []string{"127.0.0.1:9091", "[::1]:9091"}, true},
+		{"localhost:9091,unix:/run/reflection.sock", []string{"localhost:9091", "unix:/run/reflection.sock"}, true},
+		{"unix:", nil, false},
+		{",", nil, false},
+	}
+
+	for _, table := range tables {
+		addresses, err := parseListenAddresses(table.list, 9091)
+		if (err == nil) != table.valid {
+			t.Errorf("List %q, unexpected error %v", table.list, err)
+			continue
+		}
+		if len(addresses) != len(table.addresses) {
+			t.Errorf("List %q, expected %v, got %v", table.list, table.addresses, addresses)
+			continue
+		}
+		for i, addr := range addresses {
+			if addr.String() != table.addresses[i] {
+				t.Errorf("List %q, expected %v, got %v", table.list, table.addresses, addresses)
+				break
+			}
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflection")
+	Check(err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "reflection.toml")
+	writeConfig := func(content string) {
+		Check(ioutil.WriteFile(filename, []byte(content), 0600))
+	}
+
+	defer func() {
+		for _, name := range []string{"config", "api-addr", "port", "cache-timeout", "sync"} {
+			f := flag.Lookup(name)
+			Check(f.Value.Set(f.DefValue))
+		}
+	}()
+	Check(os.Setenv("REFLECTION_CACHE_TIMEOUT", "30"))
+	defer os.Unsetenv("REFLECTION_CACHE_TIMEOUT")
+
+	writeConfig("api-addr = \"http://qbittorrent:8080/\"\nport = 9000\ncache-timeout = 20\nsync = false\n")
+	err = loadConfig([]string{"-config", filename, "-p", "9092"})
+	if err != nil {
+		t.Fatal("Unexpected error: ", err)
+	}
+	if *apiAddr != "http://qbittorrent:8080/" || *useSync {
+		t.Errorf("Values from the file were not applied: %s, %t", *apiAddr, *useSync)
+	}
+	if *port != 9092 {
+		t.Errorf("Command line should take precedence, got port %d", *port)
+	}
+	if *cacheTimeout != 30 {
+		t.Errorf("Environment should take precedence over the file, got cache timeout %d", *cacheTimeout)
+	}
+
+	tables := []struct {
+		content string
+		err     string
+	}{
+		{"cache-timeout = \"soon\"\n", "invalid value \"soon\" for cache-timeout"},
+		{"cache-timeout = 10\nunknown = 1\nhash-password = \"secret\"\n", "unknown settings: hash-password, unknown"},
+		{"listen = [\"127.0.0.1:9091\"]\n", "listen must be a string"},
+		{"port = ", "toml"},
+	}
+	for _, table := range tables {
+		writeConfig(table.content)
+		Check(os.Unsetenv("REFLECTION_CACHE_TIMEOUT"))
+		_, err := applyConfig(nil)
+		if err == nil || !strings.Contains(err.Error(), table.err) {
+			t.Errorf("Config %q, expected error with %q, got %v", table.content, table.err, err)
+		}
+	}
+}
+
+func TestPrimaryMIMEType(t *testing.T) {
+	tables := []struct {
+		files    []qBT.PropertiesFiles
+		mimeType string
+	}{
+		{nil, "application/octet-stream"},
+		{[]qBT.PropertiesFiles{{Name: "dir/unknown.extension", Size: 100}}, "application/octet-stream"},
+		{[]qBT.PropertiesFiles{{Name: "dir/a.png", Size: 100}, {Name: "dir/b.json", Size: 10}}, "image/png"},
+		{[]qBT.PropertiesFiles{{Name: "a.png", Size: 100}, {Name: "b.json", Size: 60}, {Name: "c.json", Size: 60}}, "application/json"},
+	}
+
+	for _, table := range tables {
+		if mimeType := primaryMIMEType(table.files); mimeType != table.mimeType {
+			t.Errorf("Files %v, expected %s, got %s", table.files, table.mimeType, mimeType)
+		}
+	}
+}
+
+func TestMapPeersFrom(t *testing.T) {
+	peers := map[string]qBT.PeerInfo{
+		"1.1.1.1:1": {Flags: "D U K E"},
+		"1.1.1.1:2": {Flags: "I d H"},
+		"1.1.1.1:3": {Flags: "D H E"},
+		"1.1.1.1:4": {Flags: "X P"},
+		"1.1.1.1:5": {Flags: "L"},
+		"1.1.1.1:6": {Flags: ""},
+	}
+	dst := make(JsonMap)
+	MapPeersFrom(dst, peers)
+
+	expected := transmission.PeersFrom{FromDht: 1, FromIncoming: 1, FromLpd: 1, FromPex: 1, FromTracker: 2}
+	if peersFrom := dst["peersFrom"]; peersFrom != expected {
+		t.Errorf("Expected %+v, got %+v", expected, peersFrom)
+	}
+}
+
+func TestMapPeerFlags(t *testing.T) {
+	tables := []struct {
+		peer     qBT.PeerInfo
+		expected transmission.PeerInfo
+	}{
+		{qBT.PeerInfo{Flags: "D U E"}, transmission.PeerInfo{IsDownloadingFrom: true, IsUploadingTo: true,
+			ClientIsInterested: true, PeerIsInterested: true, IsEncrypted: true}},
+		{qBT.PeerInfo{Flags: "d u I P"}, transmission.PeerInfo{ClientIsInterested: true, ClientIsChoked: true,
+			PeerIsInterested: true, PeerIsChoked: true, IsIncoming: true, IsUTP: true}},
+		{qBT.PeerInfo{Flags: "K ? e", Connection: "μTP"}, transmission.PeerInfo{IsEncrypted: true, IsUTP: true}},
+		{qBT.PeerInfo{}, transmission.PeerInfo{ClientIsChoked: true, PeerIsChoked: true}},
+	}
+
+	for _, table := range tables {
+		var result transmission.PeerInfo
+		mapPeerFlags(&result, table.peer)
+		if result != table.expected {
+			t.Errorf("Flags %q, expected %+v, got %+v", table.peer.Flags, table.expected, result)
+		}
+	}
+}
+
+func TestTorrentPeersSync(t *testing.T) {
+	const hash = "842783e3005495d5d1637f5364b59343c7844707"
+	const removedHash = "0000000000000000000000000000000000000000"
+	_, stop := startTestServer(t, false)
+	defer stop()
+
+	gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=1")
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/info").
+		Reply(200).
+		File("testdata/torrent_list.json")
+	fullUpdate := func(hash string) {
+		gock.New(testAPIAddr).
+			Get("/api/v2/sync/torrentPeers").
+			MatchParam("hash", hash).
+			MatchParam("rid", "0").
+			Reply(200).
+			BodyString(`{"full_update": true, "rid": 1, "peers": {
+				"1.1.1.1:1": {"ip": "1.1.1.1", "port": 1, "flags": "D", "dl_speed": 100},
+				"2.2.2.2:2": {"ip": "2.2.2.2", "port": 2, "flags": "U", "up_speed": 200}}}`)
+	}
+	// A non-incremental request doesn't change the sync state
+	fullUpdate(hash)
+	fullUpdate(hash)
+	gock.New(testAPIAddr).
+		Get("/api/v2/sync/torrentPeers").
+		MatchParam("hash", hash).
+		MatchParam("rid", "1").
+		Reply(200).
+		BodyString(`{"rid": 2, "peers": {"1.1.1.1:1": {"dl_speed": 50}, "3.3.3.3:3": {"ip": "3.3.3.3", "port": 3}},
+			"peers_removed": ["2.2.2.2:2"]}`)
+
+	conn := qBTConn.Session("test")
+	if loggedIn, err := conn.Login("admin", "adminadmin"); !loggedIn || err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	Check(conn.UpdateTorrentsList())
+
+	peers, err := conn.GetTorrentPeers(hash, false)
+	if err != nil || len(peers) != 2 {
+		t.Errorf("Unexpected result: %+v, %v", peers, err)
+	}
+	peers, err = conn.GetTorrentPeers(hash, true)
+	if err != nil || len(peers) != 2 || peers["2.2.2.2:2"].Up_speed != 200 {
+		t.Errorf("Unexpected full update result: %+v, %v", peers, err)
+	}
+	peers, err = conn.GetTorrentPeers(hash, true)
+	if err != nil || len(peers) != 2 {
+		t.Errorf("Unexpected partial update result: %+v", peers)
+	}
+	if peer := peers["1.1.1.1:1"]; peer.Dl_speed != 50 || peer.Flags != "D" || peer.IP != "1.1.1.1" {
+		t.Errorf("Changes weren't merged: %+v", peer)
+	}
+	if peer := peers["3.3.3.3:3"]; peer.Port != 3 {
+		t.Errorf("New peer wasn't added: %+v", peer)
+	}
+
+	// State of a torrent which is no longer in the list is dropped
+	fullUpdate(removedHash)
+	fullUpdate(removedHash)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.GetTorrentPeers(removedHash, true); err != nil {
+			t.Error("Unexpected error: ", err)
+		}
+	}
+
+	// So is state of a torrent which hasn't been requested for a while
+	defer func(timeout time.Duration) { qBT.PEERS_IDLE_TIMEOUT = timeout }(qBT.PEERS_IDLE_TIMEOUT)
+	qBT.PEERS_IDLE_TIMEOUT = 0
+	fullUpdate(hash)
+	time.Sleep(time.Millisecond)
+	if _, err := conn.GetTorrentPeers(hash, true); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	if !gock.IsDone() || gock.HasUnmatchedRequest() {
+		t.Error("Unexpected sync requests")
+	}
+}
+
+func TestRPCVersions(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	gock.New(testAPIAddr).
+		Get("/api/v2/app/preferences").
+		Persist().
+		Reply(200).
+		JSON(map[string]interface{}{})
+	gock.New(testAPIAddr).
+		Get("/api/v2/app/version").
+		Persist().
+		Reply(200).
+		BodyString("v4.1.6")
+	gock.New(testAPIAddr).
+		Get("/api/v2/transfer/speedLimitsMode").
+		Persist().
+		Reply(200).
+		BodyString("0")
+
+	prevRPCVersion := *rpcVersion
+	defer func() { *rpcVersion = prevRPCVersion }()
+
+	newFields := []string{"percentComplete", "sequential_download", "group"}
+	for _, version := range []uint{transmission.RPCVersionLegacy, transmission.RPCVersionLatest} {
+		*rpcVersion = version
+
+		torrents := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"fields": ["id", "percentComplete", "sequential_download", "group"]}}`)["torrents"].([]interface{})
+		for _, torrent := range torrents {
+			for _, field := range newFields {
+				if _, exists := torrent.(map[string]interface{})[field]; exists != (version >= 17) {
+					t.Errorf("rpc-version %d, field %s is present: %t", version, field, exists)
+				}
+			}
+		}
+
+		session := rpcRequest(server.URL, `{"method": "session-get"}`)
+		if session["rpc-version"] != float64(version) {
+			t.Errorf("Expected rpc-version %d, got %v", version, session["rpc-version"])
+		}
+		if _, exists := session["rpc-version-semver"]; exists != (version >= 17) {
+			t.Errorf("rpc-version %d, rpc-version-semver is present: %t", version, exists)
+		}
+		if !strings.HasPrefix(session["version"].(string), transmission.Releases[int(version)].Version+" ") {
+			t.Errorf("rpc-version %d, unexpected version %s", version, session["version"])
+		}
+	}
+}
+
+func TestTorrentSetSequentialDownload(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	prevRPCVersion := *rpcVersion
+	*rpcVersion = transmission.RPCVersionLatest
+	defer func() { *rpcVersion = prevRPCVersion }()
+
+	torrents := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"fields": ["id", "hashString", "sequential_download"]}}`)["torrents"].([]interface{})
+	torrent := torrents[1].(map[string]interface{})
+	if torrent["sequential_download"] != false {
+		t.Errorf("Unexpected sequential_download %v", torrent["sequential_download"])
+	}
+
+	toggleMock := gock.New(testAPIAddr).
+		Post("/api/v2/torrents/toggleSequentialDownload").
+		MatchType("url").
+		BodyString("^hashes=" + torrent["hashString"].(string) + "$").
+		Reply(200)
+	rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-set", "arguments": {"ids": [%v], "sequential_download": true}}`, torrent["id"]))
+	if !toggleMock.Mock.Done() {
+		t.Error("Sequential download was not enabled")
+	}
+	// Already disabled, nothing is sent to qBittorrent
+	rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-set", "arguments": {"ids": [%v], "sequential_download": false}}`, torrent["id"]))
+
+	// A torrent which has disappeared from the list is skipped
+	if err := qBTConn.SetSequentialDownload("0000000000000000000000000000000000000000", true); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	if err := qBTConn.SetFirstLastPieceFirst("0000000000000000000000000000000000000000", true); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+	if gock.HasUnmatchedRequest() {
+		t.Error("Unexpected qBittorrent requests")
+	}
+}
+
+func TestTorrentGetFields(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	// Only properties are needed for the requested fields, other endpoints are not mocked
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/properties").
+		MatchParam("hash", "842783e3005495d5d1637f5364b59343c7844707").
+		Reply(200).
+		File("testdata/torrent_2_properties.json")
+
+	torrents := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"fields": ["id", "hashString"]}}`)["torrents"].([]interface{})
+	id := torrents[1].(map[string]interface{})["id"]
+
+	torrents = rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-get", "arguments": {"ids": [%v], "fields": ["id", "name", "pieceSize", "isPrivate", "noSuchField"]}}`, id))["torrents"].([]interface{})
+	torrent := torrents[0].(map[string]interface{})
+	if len(torrent) != 5 {
+		t.Errorf("Unexpected fields: %v", torrent)
+	}
+	if torrent["name"] != "ubuntu-18.04.2-live-server-amd64.iso" || torrent["pieceSize"] == nil || torrent["isPrivate"] != false {
+		t.Errorf("Unexpected values: %v", torrent)
+	}
+	if value, exists := torrent["noSuchField"]; !exists || value != nil {
+		t.Errorf("Unknown field should be null, got %v", value)
+	}
+}
+
+func TestTorrentGetTable(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	objects := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"fields": ["id", "name"]}}`)["torrents"].([]interface{})
+	table := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"format": "table", "fields": ["id", "name", "noSuchField"]}}`)["torrents"].([]interface{})
+	if len(table) != len(objects)+1 {
+		t.Fatalf("Expected %d rows, got %d", len(objects)+1, len(table))
+	}
+	if header := fmt.Sprint(table[0]); header != "[id name noSuchField]" {
+		t.Errorf("Unexpected header row: %s", header)
+	}
+	for i, object := range objects {
+		row := table[i+1].([]interface{})
+		expected := object.(map[string]interface{})
+		if len(row) != 3 || row[0] != expected["id"] || row[1] != expected["name"] || row[2] != nil {
+			t.Errorf("Unexpected row %v, expected %v", row, expected)
+		}
+	}
+
+	resp := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"ids": "recently-active", "format": "table", "fields": ["id"]}}`)
+	if header := fmt.Sprint(resp["torrents"].([]interface{})[0]); header != "[id]" {
+		t.Errorf("Unexpected header row: %s", header)
+	}
+	if _, exists := resp["removed"]; !exists {
+		t.Error("removed list is missing")
+	}
+}
+
+func TestFieldsHandler(t *testing.T) {
+	_, stop := startTestServer(t, false)
+	defer stop()
+	gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		BodyString("password=wrong&username=admin").
+		Reply(200).
+		BodyString("Fails.")
+	gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		BodyString("password=adminadmin&username=admin").
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=1")
+
+	request := httptest.NewRequest("GET", "/debug/fields", nil)
+	request.SetBasicAuth("admin", "wrong")
+	recorder := httptest.NewRecorder()
+	fieldsHandler(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without valid credentials, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+
+	request.SetBasicAuth("admin", "adminadmin")
+	recorder = httptest.NewRecorder()
+	fieldsHandler(recorder, request)
+
+	var resp struct {
+		Fields []struct {
+			Name      string
+			Source    string
+			Since     int
+			Available bool
+		}
+	}
+	Check(json.Unmarshal(recorder.Body.Bytes(), &resp))
+	if len(resp.Fields) != len(torrentFields) {
+		t.Errorf("Expected %d fields, got %d", len(torrentFields), len(resp.Fields))
+	}
+	for _, field := range resp.Fields {
+		if field.Name == "file-count" && (field.Source != "files" || field.Since != 17) {
+			t.Errorf("Unexpected file-count field %v", field)
+		}
+	}
+}
+
+// TestFieldSources makes sure that every field which isn't converted from the torrents list
+// is produced by its source
+func TestFieldSources(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+	setUpMocks(testAPIAddr, "842783e3005495d5d1637f5364b59343c7844707", "2")
+
+	prevRPCVersion := *rpcVersion
+	*rpcVersion = transmission.RPCVersionLatest
+	defer func() { *rpcVersion = prevRPCVersion }()
+
+	var names []string
+	for name, field := range torrentFields {
+		if field.Convert == nil {
+			names = append(names, name)
+		}
+	}
+	torrents := rpcRequest(server.URL, `{"method": "torrent-get", "arguments": {"fields": ["id", "hashString"]}}`)["torrents"].([]interface{})
+	id := torrents[1].(map[string]interface{})["id"]
+	fields, _ := json.Marshal(names)
+	torrents = rpcRequest(server.URL, fmt.Sprintf(`{"method": "torrent-get", "arguments": {"ids": [%v], "fields": %s}}`, id, fields))["torrents"].([]interface{})
+	torrent := torrents[0].(map[string]interface{})
+	for _, name := range names {
+		if torrent[name] == nil {
+			t.Errorf("Field %s isn't produced by the %s source", name, torrentFields[name].Source)
+		}
+	}
+}
+
+const testAPIAddr = "http://localhost:8080"
+
+// startTestServer starts an RPC server in front of a mocked qBittorrent.
+// State left by previous tests, such as mocks and caches, is reset.
+// The returned function stops the server and disables mocking.
+func startTestServer(t *testing.T, useSync bool) (*httptest.Server, func()) {
+	t.Helper()
+	log.SetLevel(currentLogLevel)
+	gock.Flush()
+	gock.CleanUnmatchedRequest()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	gock.InterceptClient(client)
+	qBTConn.Init(testAPIAddr, client, useSync)
+	currentSettings.Store(&runtimeSettings{authenticator: NewQBTAuthenticator()})
+	manualAnnounces.times = nil
+	for _, cache := range []*Cache{&propsCache, &trackersCache, &peersFromCache} {
+		cache.Values, cache.FilledAt = nil, nil
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	return server, func() {
+		server.CloseClientConnections()
+		server.Close()
+		gock.Off()
+	}
+}
+
+// newTestServer is startTestServer with a successful login and two torrents in qBittorrent
+func newTestServer(t *testing.T) (*httptest.Server, func()) {
+	t.Helper()
+	server, stop := startTestServer(t, false)
+	gock.New(testAPIAddr).
+		Post("/api/v2/auth/login").
+		Persist().
+		Reply(200).
+		SetHeader("Set-Cookie", "SID=1")
+	gock.New(testAPIAddr).
+		Get("/api/v2/torrents/info").
+		Persist().
+		Reply(200).
+		File("testdata/torrent_list.json")
+	return server, stop
+}
+
+// newRPCClient connects a transmissionrpc client to the test server
+func newRPCClient(t *testing.T, server *httptest.Server) *transmissionrpc.Client {
+	t.Helper()
+	serverAddr := server.Listener.Addr().(*net.TCPAddr)
+	client, err := transmissionrpc.New(serverAddr.IP.String(), "", "",
+		&transmissionrpc.AdvancedConfig{Port: uint16(serverAddr.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// torrentSetTest is a torrent-set request for the second test torrent
+// and qBittorrent API calls that it must make
+type torrentSetTest struct {
+	name     string
+	payload  transmissionrpc.TorrentSetPayload
+	requests []expectedRequest
+}
+
+type expectedRequest struct {
+	path string // Relative to /api/v2/torrents/
+	body string
+}
+
+// runTorrentSetTests sends the requests one by one and checks that the expected qBittorrent API calls were made
+func runTorrentSetTests(t *testing.T, tables []torrentSetTest) {
+	t.Helper()
+	server, stop := newTestServer(t)
+	defer stop()
+
+	setUpMocks(testAPIAddr, "cf7da7ab4d4e6125567bd979994f13bb1f23dddd", "1")
+	setUpMocks(testAPIAddr, "842783e3005495d5d1637f5364b59343c7844707", "2")
+
+	transmissionbt := newRPCClient(t, server)
+	torrents, err := transmissionbt.TorrentGetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range tables {
+		var mocks []gock.Mock
+		for _, request := range table.requests {
+			mocks = append(mocks, gock.New(testAPIAddr).
+				Post("/api/v2/torrents/"+request.path).
+				MatchType("url").
+				BodyString("^"+regexp.QuoteMeta(request.body)+"$").
+				Reply(200).Mock)
+		}
+
+		payload := table.payload
+		payload.IDs = []int64{*torrents[1].ID}
+		if err := transmissionbt.TorrentSet(&payload); err != nil {
+			t.Errorf("%s: %v", table.name, err)
+		}
+		for i, mock := range mocks {
+			if !mock.Done() {
+				t.Errorf("%s: %s wasn't called with %s", table.name, table.requests[i].path, table.requests[i].body)
+			}
+		}
+	}
+}
+
+// rpcRequest sends a raw RPC request and returns its arguments
+func rpcRequest(serverURL string, request string) JsonMap {
+	req, err := http.NewRequest("POST", serverURL, strings.NewReader(request))
+	Check(err)
+	req.Header.Set(SESSION_ID_HEADER, sessionID)
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+	Check(err)
+	defer resp.Body.Close()
+	var body struct {
+		Result    string
+		Arguments JsonMap
+	}
+	Check(json.NewDecoder(resp.Body).Decode(&body))
+	if body.Result != "success" {
+		panic(body.Result)
+	}
+	return body.Arguments
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reflection")
+	Check(err)
+	defer os.RemoveAll(dir)
+	addr := listenAddress{network: "unix", address: filepath.Join(dir, "reflection.sock")}
+
+	listener, err := listen(addr, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(addr.address); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Unexpected socket permissions: %v, %v", info.Mode(), err)
+	}
+
+	// The socket of a running process is kept
+	if _, err := listen(addr, 0); err == nil {
+		t.Error("Socket in use was replaced")
+	}
+
+	// A stale socket is replaced
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listen(addr, 0)
+	if err != nil {
+		t.Fatal("Stale socket wasn't replaced: ", err)
+	}
+	listener.Close()
+
+	for _, mode := range []string{"660", "0660"} {
+		if parsed, err := parseSocketMode(mode); err != nil || parsed != 0660 {
+			t.Errorf("Mode %q, unexpected result %v, %v", mode, parsed, err)
+		}
+	}
+	for _, mode := range []string{"0", "rw", "0999", "01777"} {
+		if _, err := parseSocketMode(mode); err == nil {
+			t.Errorf("Invalid mode %q was accepted", mode)
+		}
+	}
+}
+
 func setUpSyncEndpoint(apiAddr string) {
 	gock.New(apiAddr).
 		Get("/api/v2/sync/maindata").
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const UNIX_SOCKET_PREFIX = "unix:"
+
+type listenAddress struct {
+	network string // "tcp" or "unix"
+	address string
+}
+
+func (addr listenAddress) String() string {
+	if addr.network == "unix" {
+		return UNIX_SOCKET_PREFIX + addr.address
+	}
+	return addr.address
+}
+
+// parseListenAddresses parses a comma-separated list of "host:port" and "unix:/path" entries.
+// An empty list means all interfaces on the default port.
+func parseListenAddresses(list string, defaultPort uint) (addresses []listenAddress, err error) {
+	if strings.TrimSpace(list) == "" {
+		return []listenAddress{{network: "tcp", address: fmt.Sprintf(":%d", defaultPort)}}, nil
+	}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case strings.HasPrefix(entry, UNIX_SOCKET_PREFIX):
+			path := strings.TrimPrefix(entry, UNIX_SOCKET_PREFIX)
+			if path == "" {
+				return nil, fmt.Errorf("empty Unix socket path in %q", entry)
+			}
+			addresses = append(addresses, listenAddress{network: "unix", address: path})
+		default:
+			if _, _, err := net.SplitHostPort(entry); err != nil {
+				// Only an address was specified
+				entry = net.JoinHostPort(strings.Trim(entry, "[]"), fmt.Sprint(defaultPort))
+			}
+			addresses = append(addresses, listenAddress{network: "tcp", address: entry})
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("no listen addresses specified")
+	}
+	return addresses, nil
+}
+
+// makeTLSConfig returns nil if TLS is not configured
+func makeTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("client certificates require -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both -tls-cert and -tls-key must be specified")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// parseSocketMode parses octal permissions of Unix sockets, an empty string means that they are set by umask
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value == 0 || value > 0777 {
+		return 0, fmt.Errorf("invalid permissions %q, expected an octal number such as 0660", mode)
+	}
+	return os.FileMode(value), nil
+}
+
+// listen opens a listener. Permissions of a Unix socket are changed to socketMode unless it's 0.
+func listen(addr listenAddress, socketMode os.FileMode) (net.Listener, error) {
+	if addr.network != "unix" {
+		return net.Listen(addr.network, addr.address)
+	}
+
+	// A socket left after a previous run would make Listen fail, but a socket of a running process must be kept
+	if info, err := os.Stat(addr.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", addr.address)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is used by another process", addr.address)
+		}
+		if !isConnectionRefused(err) {
+			return nil, err
+		}
+		log.WithField("path", addr.address).Info("Removing stale Unix socket")
+		if err := os.Remove(addr.address); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen(addr.network, addr.address)
+	if err != nil {
+		return nil, err
+	}
+	if socketMode != 0 {
+		if err := os.Chmod(addr.address, socketMode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+func isConnectionRefused(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
+
+// serve starts all listeners and blocks until one of them fails.
+// TLS is used for TCP listeners only, Unix sockets are meant for a reverse proxy on the same host.
+func serve(handler http.Handler, addresses []listenAddress, tlsConfig *tls.Config, socketMode os.FileMode) error {
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, addr := range addresses {
+		listener, err := listen(addr, socketMode)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		server := &http.Server{Handler: handler}
+		if addresses[i].network == "tcp" && tlsConfig != nil {
+			server.TLSConfig = tlsConfig
+			log.Info("Serving HTTPS on ", addresses[i])
+			go func(server *http.Server, listener net.Listener) {
+				errs <- server.ServeTLS(listener, "", "")
+			}(server, listener)
+		} else {
+			log.Info("Serving HTTP on ", addresses[i])
+			go func(server *http.Server, listener net.Listener) {
+				errs <- server.Serve(listener)
+			}(server, listener)
+		}
+	}
+	return <-errs
+}
@@ -22,9 +22,11 @@ func Any(vs []string, dst string) bool {
 	return false
 }
 
-func DoGetWithCookies(path string, cookies *string) []byte {
+func DoGetWithCookies(path string, cookies *string) ([]byte, error) {
 	httpReq, err := http.NewRequest("GET", path, nil)
-	Check(err)
+	if err != nil {
+		return nil, InvalidArgument("Can't download torrent: %v", err)
+	}
 	if cookies != nil {
 		header := http.Header{}
 		header.Add("Cookie", *cookies)
@@ -32,8 +34,16 @@ func DoGetWithCookies(path string, cookies *string) []byte {
 	}
 	cl := &http.Client{}
 	resp, err := cl.Do(httpReq)
-	Check(err)
+	if err != nil {
+		return nil, InvalidArgument("Can't download torrent: %v", err)
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, InvalidArgument("Can't download torrent: %s", resp.Status)
+	}
 	data, err := ioutil.ReadAll(resp.Body)
-	return data
+	if err != nil {
+		return nil, InvalidArgument("Can't download torrent: %v", err)
+	}
+	return data, nil
 }
@@ -13,30 +13,62 @@ type RPCRequest struct {
 type GetRequest struct {
 	Ids    *json.RawMessage
 	Fields []string
+	Format string // "objects" (default) or "table"
 }
 
+const (
+	FormatObjects = "objects"
+	FormatTable   = "table"
+)
+
 type TorrentAddRequest struct {
-	Cookies           *string      //  pointer to a string of one or more cookies.
-	Download_dir      *string      `json:"download-dir"` //    path to download the torrent to
-	Filename          *string      //   filename or URL of the .torrent file
-	Metainfo          *string      //   base64-encoded .torrent content
-	Paused            *interface{} //    if true, don't start the torrent
-	Peer_limit        *int         //   maximum number of peers
-	BandwidthPriority *int         //   torrent's bandwidth tr_priority_t
-	Files_wanted      *[]JsonMap   //   indices of file(s) to download
-	Files_unwanted    *[]JsonMap   //    indices of file(s) to not download
-	Priority_high     *[]JsonMap   //    indices of high-priority file(s)
-	Priority_low      *[]JsonMap   //    indices of low-priority file(s)
-	Priority_normal   *[]JsonMap   //    indices of normal-priority file(s)
+	Cookies             *string      //  pointer to a string of one or more cookies.
+	Download_dir        *string      `json:"download-dir"` //    path to download the torrent to
+	Filename            *string      //   filename or URL of the .torrent file
+	Metainfo            *string      //   base64-encoded .torrent content
+	Paused              *interface{} //    if true, don't start the torrent
+	Peer_limit          *int         `json:"peer-limit"` //   maximum number of peers
+	BandwidthPriority   *int         //   torrent's bandwidth tr_priority_t
+	Files_wanted        *[]int       `json:"files-wanted"`        //   indices of file(s) to download
+	Files_unwanted      *[]int       `json:"files-unwanted"`      //    indices of file(s) to not download
+	Priority_high       *[]int       `json:"priority-high"`       //    indices of high-priority file(s)
+	Priority_low        *[]int       `json:"priority-low"`        //    indices of low-priority file(s)
+	Priority_normal     *[]int       `json:"priority-normal"`     //    indices of normal-priority file(s)
+	Sequential_download *bool        `json:"sequential_download"` //    download pieces in order (rpc-version 18)
+}
+
+func (req *TorrentAddRequest) HasFileSelections() bool {
+	return req.Files_wanted != nil || req.Files_unwanted != nil ||
+		req.Priority_high != nil || req.Priority_low != nil || req.Priority_normal != nil
+}
+
+// PeersFrom counts connected peers by the way they were discovered
+type PeersFrom struct {
+	FromCache    int `json:"fromCache"`
+	FromDht      int `json:"fromDht"`
+	FromIncoming int `json:"fromIncoming"`
+	FromLpd      int `json:"fromLpd"`
+	FromLtep     int `json:"fromLtep"`
+	FromPex      int `json:"fromPex"`
+	FromTracker  int `json:"fromTracker"`
 }
 
 type PeerInfo struct {
-	RateToPeer   int			`json:"rateToPeer"`
-	RateToClient int			`json:"rateToClient"`
-	Port         int			`json:"port"`
-	ClientName   interface{}	`json:"clientName"`
-	FlagStr      string			`json:"flagStr"`
-	Country      interface{}	`json:"country"`
-	Address      string			`json:"address"`
-	Progress     float64 		`json:"progress"`		//	Torrent progress (percentage/100)
+	RateToPeer         int         `json:"rateToPeer"`
+	RateToClient       int         `json:"rateToClient"`
+	Port               int         `json:"port"`
+	ClientName         interface{} `json:"clientName"`
+	FlagStr            string      `json:"flagStr"`
+	Country            interface{} `json:"country"`
+	Address            string      `json:"address"`
+	Progress           float64     `json:"progress"` //	Torrent progress (percentage/100)
+	IsEncrypted        bool        `json:"isEncrypted"`
+	IsUTP              bool        `json:"isUTP"`
+	IsIncoming         bool        `json:"isIncoming"`
+	IsDownloadingFrom  bool        `json:"isDownloadingFrom"`
+	IsUploadingTo      bool        `json:"isUploadingTo"`
+	ClientIsChoked     bool        `json:"clientIsChoked"`     // The peer chokes us
+	ClientIsInterested bool        `json:"clientIsInterested"` // We are interested in the peer's pieces
+	PeerIsChoked       bool        `json:"peerIsChoked"`       // We choke the peer
+	PeerIsInterested   bool        `json:"peerIsInterested"`
 }
@@ -2,14 +2,10 @@ package transmission
 
 type JsonMap map[string]interface{}
 
+// SpeedBytes is the number of bytes in a "KB" of speed values, as advertised in "units"
+const SpeedBytes = 1000
+
 var SessionGetBase = JsonMap{
-	"alt-speed-down":               50,
-	"alt-speed-enabled":            false,
-	"alt-speed-time-begin":         540,
-	"alt-speed-time-day":           127,
-	"alt-speed-time-enabled":       false,
-	"alt-speed-time-end":           1020,
-	"alt-speed-up":                 50,
 	"blocklist-enabled":            false,
 	"blocklist-size":               393006,
 	"blocklist-url":                "http://www.example.com/blocklist",
@@ -41,7 +37,7 @@ var SessionGetBase = JsonMap{
 			"GB",
 			"TB",
 		},
-		"speed-bytes": 1000,
+		"speed-bytes": SpeedBytes,
 		"speed-units": []string{
 			"kB/s",
 			"MB/s",
@@ -53,27 +49,20 @@ var SessionGetBase = JsonMap{
 }
 
 var TorrentGetBase = JsonMap{
-	"errorString":             "",
-	"metadataPercentComplete": 1,
-	"isFinished":              false,
-	"queuePosition":           0, // Looks like not supported by qBittorent
-	"seedRatioLimit":          2,
-	"seedRatioMode":           0, // No local limits in qBittorrent
-	"activityDate":            1443977197,
-	"secondsDownloading":      500,
-	"secondsSeeding":          80000,
-	"isPrivate":               false, // Not exposed by qBittorrent
-	"honorsSessionLimits":     true,
-	"webseedsSendingToUs":     0,
-	"bandwidthPriority":       0,
-	"seedIdleLimit":           10,
-	"seedIdleMode":            0, // TR_IDLELIMIT_GLOBAL
-	"manualAnnounceTime":      0,
-	"etaIdle":                 0,
-	"torrentFile":             "",
-	"webseeds":                []string{},
-	"peers":                   []string{},
-	"magnetLink":              "",
+	"errorString":         "",
+	"isFinished":          false,
+	"activityDate":        1443977197,
+	"secondsDownloading":  500,
+	"secondsSeeding":      80000,
+	"isPrivate":           false, // Not exposed by qBittorrent
+	"honorsSessionLimits": true,
+	"webseedsSendingToUs": 0,
+	"bandwidthPriority":   0,
+	"etaIdle":             0,
+	"torrentFile":         "",
+	"webseeds":            []string{},
+	"magnetLink":          "",
+	"group":               "", // qBittorrent has no bandwidth groups
 }
 
 var TrackerStatsTemplate = JsonMap{
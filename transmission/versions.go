@@ -0,0 +1,31 @@
+package transmission
+
+// RPC versions which Reflection can emulate
+const (
+	RPCVersionLegacy = 15 // Transmission 2.94
+	RPCVersionLatest = 18 // Transmission 4.1
+)
+
+type Release struct {
+	Version string
+	// Reported since rpc-version 17
+	SemVer string
+}
+
+var Releases = map[int]Release{
+	15: {Version: "2.94"},
+	16: {Version: "3.00"},
+	17: {Version: "4.0.6", SemVer: "5.3.0"},
+	18: {Version: "4.1.0", SemVer: "5.4.0"},
+}
+
+// RPC versions which introduced session-get fields
+var SessionFieldVersions = map[string]int{
+	"rpc-version-semver": 17,
+}
+
+// IsFieldAvailable reports whether a client which expects rpcVersion knows the field
+func IsFieldAvailable(versions map[string]int, field string, rpcVersion int) bool {
+	since, introduced := versions[field]
+	return !introduced || since <= rpcVersion
+}